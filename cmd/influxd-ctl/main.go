@@ -0,0 +1,45 @@
+// Command influxd-ctl is the cluster operator's CLI for actions that
+// don't belong on the HTTP query/write API: restoring or merging a meta
+// snapshot, and inspecting a shard rebalance plan before committing to
+// it.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "meta":
+		err = runMeta(os.Args[2:])
+	case "rebalance":
+		err = runRebalance(os.Args[2:])
+	case "-h", "-help", "--help":
+		usage()
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "influxd-ctl: unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "influxd-ctl: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `Usage: influxd-ctl <command> [arguments]
+
+Commands:
+  meta restore        Restore or merge an exported meta snapshot into the cluster
+  rebalance plan      Print the shard moves PlanRebalance would make, without applying them`)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/zhexuany/influxdb-cluster/meta"
+)
+
+func runMeta(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: influxd-ctl meta <restore> [arguments]")
+	}
+
+	switch args[0] {
+	case "restore":
+		return runMetaRestore(args[1:])
+	default:
+		return fmt.Errorf("unknown meta command %q", args[0])
+	}
+}
+
+// runMetaRestore implements `influxd-ctl meta restore`: it reads an
+// exported snapshot (see meta.Data.ExportSnapshot/ExportForMerge) from
+// a file and applies it to a running cluster via Client.ImportMeta.
+func runMetaRestore(args []string) error {
+	fs := flag.NewFlagSet("meta restore", flag.ExitOnError)
+	servers := fs.String("servers", "localhost:8091", "comma-separated list of meta server HTTP addresses")
+	merge := fs.Bool("merge", false, "merge the snapshot's databases into the cluster instead of replacing its Data outright")
+	mergePolicy := fs.String("merge-policy", "skip", "conflicting retention policy handling when -merge is set: skip, overwrite, or error")
+	dryRun := fs.Bool("dry-run", false, "report what restore would do without applying it")
+	force := fs.Bool("force", false, "proceed even if the snapshot's ClusterID doesn't match the cluster's")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: influxd-ctl meta restore [flags] <snapshot-file>")
+	}
+
+	mp, err := meta.ParseMergePolicy(*mergePolicy)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	config := meta.NewMetaConfig()
+	c := meta.NewClient(config)
+	c.SetMetaServers(strings.Split(*servers, ","))
+	if err := c.Open(); err != nil {
+		return fmt.Errorf("connect to cluster: %s", err)
+	}
+	defer c.Close()
+
+	result, err := c.ImportMeta(f, meta.ImportOptions{
+		Merge:       *merge,
+		MergePolicy: mp,
+		DryRun:      *dryRun,
+		Force:       *force,
+	})
+	if err != nil {
+		return err
+	}
+
+	if result.Replaced {
+		if result.DryRun {
+			fmt.Println("would replace the cluster's meta Data outright")
+		} else {
+			fmt.Println("replaced the cluster's meta Data")
+		}
+		return nil
+	}
+
+	verb := "added"
+	if result.DryRun {
+		verb = "would add"
+	}
+	fmt.Printf("%s %d database(s): %s\n", verb, len(result.DatabasesAdded), strings.Join(result.DatabasesAdded, ", "))
+	fmt.Printf("remapped %d shard/shard-group ID(s)\n", len(result.ShardGroupIDMap))
+	return nil
+}
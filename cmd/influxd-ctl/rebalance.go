@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/zhexuany/influxdb-cluster/meta"
+)
+
+func runRebalance(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: influxd-ctl rebalance <plan> [arguments]")
+	}
+
+	switch args[0] {
+	case "plan":
+		return runRebalancePlan(args[1:])
+	default:
+		return fmt.Errorf("unknown rebalance command %q", args[0])
+	}
+}
+
+// runRebalancePlan implements `influxd-ctl rebalance plan`: it fetches
+// the cluster's current meta snapshot, computes the moves
+// Client.PlanRebalance would make, and prints them without applying
+// anything, so an operator can inspect a plan over the meta RPC before
+// calling Client.ApplyRebalance/CommitRebalanceMove themselves.
+func runRebalancePlan(args []string) error {
+	fs := flag.NewFlagSet("rebalance plan", flag.ExitOnError)
+	servers := fs.String("servers", "localhost:8091", "comma-separated list of meta server HTTP addresses")
+	maxMoves := fs.Int("max-moves", 0, "cap the number of moves the plan returns (<= 0 means unlimited)")
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		return fmt.Errorf("usage: influxd-ctl rebalance plan [flags]")
+	}
+
+	config := meta.NewMetaConfig()
+	c := meta.NewClient(config)
+	c.SetMetaServers(strings.Split(*servers, ","))
+	if err := c.Open(); err != nil {
+		return fmt.Errorf("connect to cluster: %s", err)
+	}
+	defer c.Close()
+
+	moves := c.PlanRebalance(meta.RebalanceOptions{MaxMoves: *maxMoves})
+	if len(moves) == 0 {
+		fmt.Println("cluster is balanced: no moves planned")
+		return nil
+	}
+
+	for _, mv := range moves {
+		fmt.Printf("shard %d: node %d -> node %d\n", mv.ShardID, mv.FromNodeID, mv.ToNodeID)
+	}
+	fmt.Printf("%d move(s) planned\n", len(moves))
+	return nil
+}
@@ -0,0 +1,39 @@
+// Command meta-snapshot dumps and inspects a meta store snapshot file
+// offline, without needing a running Store to load it into.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/zhexuany/influxdb-cluster/meta"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s <snapshot-file>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := dump(flag.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "meta-snapshot: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func dump(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return meta.DumpSnapshot(f, os.Stdout)
+}
@@ -0,0 +1,312 @@
+package meta
+
+import (
+	"container/list"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// SaltBytes is the number of random bytes used to salt a password before
+// it's hashed for the in-memory authentication cache, matching the
+// convention used by older InfluxDB releases.
+const SaltBytes = 32
+
+// authUser is a cached, pre-hashed credential kept so that repeated
+// authentication of the same user doesn't have to pay the configured
+// hasher's cost (e.g. bcrypt/argon2id) on every request.
+type authUser struct {
+	bhash string // the canonical, persisted hash this entry was built from
+	salt  []byte
+	hash  []byte
+}
+
+// hashWithSalt returns a fast, non-configurable hash of salt+password used
+// only for the in-memory authCache; it is never persisted.
+func hashWithSalt(salt []byte, password string) []byte {
+	hasher := sha256.New()
+	hasher.Write(salt)
+	hasher.Write([]byte(password))
+	return hasher.Sum(nil)
+}
+
+// saltedHash generates a new random salt and returns it along with
+// hashWithSalt(salt, password).
+func saltedHash(password string) (salt, hash []byte, err error) {
+	salt = make([]byte, SaltBytes)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, err
+	}
+	return salt, hashWithSalt(salt, password), nil
+}
+
+// PasswordHasher hashes and verifies user passwords for persistence in the
+// meta store. Algo identifies the hasher so a hash produced by one
+// implementation can be routed back to a matching PasswordHasher for
+// Compare, letting users hashed under different algorithms coexist across
+// a rolling upgrade.
+type PasswordHasher interface {
+	// Hash returns the persisted representation of password, tagged with
+	// the hasher's algorithm so Compare can later dispatch correctly.
+	Hash(password string) ([]byte, error)
+
+	// Compare returns nil if password matches hash, or an error
+	// otherwise.
+	Compare(hash []byte, password string) error
+
+	// Algo returns the short algorithm tag this hasher stamps on its
+	// output, e.g. "bcrypt", "pbkdf2", "argon2id".
+	Algo() string
+}
+
+// bcryptCost is the cost associated with generating password with bcrypt.
+// This setting is lowered during testing to improve test suite performance.
+var bcryptCost = bcrypt.DefaultCost
+
+// bcryptHasher is the PasswordHasher used by default; it delegates to
+// golang.org/x/crypto/bcrypt and is self-describing, so its output isn't
+// prefixed with an explicit algo tag.
+type bcryptHasher struct {
+	cost int
+}
+
+// NewBCryptPasswordHasher returns a PasswordHasher backed by bcrypt.
+func NewBCryptPasswordHasher(cost int) PasswordHasher {
+	if cost <= 0 {
+		cost = bcryptCost
+	}
+	return &bcryptHasher{cost: cost}
+}
+
+func (h *bcryptHasher) Hash(password string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), h.cost)
+}
+
+func (h *bcryptHasher) Compare(hash []byte, password string) error {
+	return bcrypt.CompareHashAndPassword(hash, []byte(password))
+}
+
+func (h *bcryptHasher) Algo() string { return "bcrypt" }
+
+// pbkdf2Iterations is the default iteration count for pbkdf2Hasher.
+const pbkdf2Iterations = 100000
+
+// pbkdf2KeyLen is the derived key length, in bytes, for pbkdf2Hasher.
+const pbkdf2KeyLen = 32
+
+// pbkdf2Hasher hashes passwords with PBKDF2-SHA256. Its output is tagged
+// "$pbkdf2$<iterations>$<base64 salt>$<base64 derived key>" so Compare can
+// recover the salt and iteration count used to produce it.
+type pbkdf2Hasher struct {
+	iterations int
+}
+
+// NewPBKDF2PasswordHasher returns a PasswordHasher backed by PBKDF2-SHA256
+// run for the given number of iterations (0 uses pbkdf2Iterations).
+func NewPBKDF2PasswordHasher(iterations int) PasswordHasher {
+	if iterations <= 0 {
+		iterations = pbkdf2Iterations
+	}
+	return &pbkdf2Hasher{iterations: iterations}
+}
+
+func (h *pbkdf2Hasher) Hash(password string) ([]byte, error) {
+	salt := make([]byte, SaltBytes)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key := pbkdf2.Key([]byte(password), salt, h.iterations, pbkdf2KeyLen, sha256.New)
+	return []byte(fmt.Sprintf("$pbkdf2$%d$%s$%s", h.iterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))), nil
+}
+
+func (h *pbkdf2Hasher) Compare(hash []byte, password string) error {
+	iterations, salt, key, err := parsePBKDF2Hash(string(hash))
+	if err != nil {
+		return err
+	}
+	got := pbkdf2.Key([]byte(password), salt, iterations, len(key), sha256.New)
+	if !constantTimeEqual(got, key) {
+		return ErrAuthenticate
+	}
+	return nil
+}
+
+func (h *pbkdf2Hasher) Algo() string { return "pbkdf2" }
+
+func parsePBKDF2Hash(hash string) (iterations int, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 || parts[0] != "" || parts[1] != "pbkdf2" {
+		return 0, nil, nil, fmt.Errorf("meta: malformed pbkdf2 hash")
+	}
+	if _, err := fmt.Sscanf(parts[2], "%d", &iterations); err != nil {
+		return 0, nil, nil, fmt.Errorf("meta: malformed pbkdf2 iteration count: %s", err)
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[3]); err != nil {
+		return 0, nil, nil, err
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return 0, nil, nil, err
+	}
+	return iterations, salt, key, nil
+}
+
+// argon2idTime/Memory/Threads are the argon2id cost parameters used by
+// argon2idHasher.
+const (
+	argon2idTime    = 1
+	argon2idMemory  = 64 * 1024
+	argon2idThreads = 4
+)
+
+// argon2idHasher hashes passwords with argon2id. Its output is tagged
+// "$argon2id$<base64 salt>$<base64 derived key>".
+type argon2idHasher struct{}
+
+// NewArgon2idPasswordHasher returns a PasswordHasher backed by argon2id.
+func NewArgon2idPasswordHasher() PasswordHasher { return &argon2idHasher{} }
+
+func (h *argon2idHasher) Hash(password string) ([]byte, error) {
+	salt := make([]byte, SaltBytes)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2idTime, argon2idMemory, argon2idThreads, pbkdf2KeyLen)
+	return []byte(fmt.Sprintf("$argon2id$%s$%s",
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))), nil
+}
+
+func (h *argon2idHasher) Compare(hash []byte, password string) error {
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 4 || parts[0] != "" || parts[1] != "argon2id" {
+		return fmt.Errorf("meta: malformed argon2id hash")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return err
+	}
+	got := argon2.IDKey([]byte(password), salt, argon2idTime, argon2idMemory, argon2idThreads, uint32(len(key)))
+	if !constantTimeEqual(got, key) {
+		return ErrAuthenticate
+	}
+	return nil
+}
+
+func (h *argon2idHasher) Algo() string { return "argon2id" }
+
+func constantTimeEqual(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	var v byte
+	for i := range a {
+		v |= a[i] ^ b[i]
+	}
+	return v == 0
+}
+
+// passwordHasherForHash returns the PasswordHasher that produced hash,
+// inferred from its tag prefix. Untagged hashes (the bcrypt format, which
+// starts with "$2") fall back to bcrypt so existing users keep working
+// after this change is deployed.
+func passwordHasherForHash(hash []byte) PasswordHasher {
+	s := string(hash)
+	switch {
+	case strings.HasPrefix(s, "$pbkdf2$"):
+		return NewPBKDF2PasswordHasher(0)
+	case strings.HasPrefix(s, "$argon2id$"):
+		return NewArgon2idPasswordHasher()
+	default:
+		return NewBCryptPasswordHasher(0)
+	}
+}
+
+// errAuthCacheMiss is returned internally by authCacheLRU.get on a miss;
+// it never escapes the package.
+var errAuthCacheMiss = errors.New("meta: auth cache miss")
+
+// authCacheLRU is a fixed-size, least-recently-used cache of authUser
+// entries keyed by username. It exists so a busy cluster with many users
+// doesn't let Client.authCache grow without bound.
+type authCacheLRU struct {
+	size int
+	ll   *list.List
+	m    map[string]*list.Element
+}
+
+type authCacheEntry struct {
+	username string
+	user     authUser
+}
+
+// newAuthCacheLRU returns an authCacheLRU bounded at size entries. A
+// size <= 0 falls back to DefaultAuthCacheSize.
+func newAuthCacheLRU(size int) *authCacheLRU {
+	if size <= 0 {
+		size = DefaultAuthCacheSize
+	}
+	return &authCacheLRU{
+		size: size,
+		ll:   list.New(),
+		m:    make(map[string]*list.Element),
+	}
+}
+
+func (c *authCacheLRU) get(username string) (authUser, bool) {
+	e, ok := c.m[username]
+	if !ok {
+		return authUser{}, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*authCacheEntry).user, true
+}
+
+func (c *authCacheLRU) set(username string, user authUser) {
+	if e, ok := c.m[username]; ok {
+		e.Value.(*authCacheEntry).user = user
+		c.ll.MoveToFront(e)
+		return
+	}
+
+	e := c.ll.PushFront(&authCacheEntry{username: username, user: user})
+	c.m[username] = e
+
+	if c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		if oldest != nil {
+			c.ll.Remove(oldest)
+			delete(c.m, oldest.Value.(*authCacheEntry).username)
+		}
+	}
+}
+
+func (c *authCacheLRU) delete(username string) {
+	if e, ok := c.m[username]; ok {
+		c.ll.Remove(e)
+		delete(c.m, username)
+	}
+}
+
+func (c *authCacheLRU) len() int { return c.ll.Len() }
+
+// usernames returns a snapshot of the usernames currently cached.
+func (c *authCacheLRU) usernames() []string {
+	a := make([]string, 0, len(c.m))
+	for username := range c.m {
+		a = append(a, username)
+	}
+	return a
+}
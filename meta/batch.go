@@ -0,0 +1,59 @@
+package meta
+
+import (
+	"github.com/gogo/protobuf/proto"
+	"github.com/zhexuany/influxdb-cluster/meta/internal"
+)
+
+// buildCommand marshals value into desc and wraps it in an
+// internal.Command of type typ, the same way every single-command
+// helper (CreateContinuousQuery, CreateShardGroup, ...) builds the
+// command it hands to retryUntilExec.
+func buildCommand(typ internal.Command_Type, desc *proto.ExtensionDesc, value interface{}) *internal.Command {
+	cmd := &internal.Command{Type: &typ}
+	if err := proto.SetExtension(cmd, desc, value); err != nil {
+		panic(err)
+	}
+	return cmd
+}
+
+// Batch collects an ordered sequence of commands to commit atomically in
+// a single raft proposal, instead of one retryUntilExec round-trip per
+// command. Build one with Client.Batch, append to it with the *In
+// variant of any single-command helper (CreateContinuousQueryIn,
+// CreateShardGroupIn, DeleteMetaNodeIn, ...), then call Commit. This
+// mirrors etcd's Txn API and is meant for bulk operations like
+// registering hundreds of continuous queries on cluster bootstrap, or
+// precreating shard groups across every retention policy at once.
+type Batch struct {
+	c    *Client
+	cmds []*internal.Command
+}
+
+// Batch returns a new, empty Batch bound to c.
+func (c *Client) Batch() *Batch {
+	return &Batch{c: c}
+}
+
+// add appends a command built from typ/desc/value to the batch.
+func (b *Batch) add(typ internal.Command_Type, desc *proto.ExtensionDesc, value interface{}) {
+	b.cmds = append(b.cmds, buildCommand(typ, desc, value))
+}
+
+// Len returns the number of commands appended to the batch so far.
+func (b *Batch) Len() int {
+	return len(b.cmds)
+}
+
+// Commit submits every command appended to the batch as a single
+// internal.BatchCommand, applied atomically (all-or-nothing) in one raft
+// proposal. It's a no-op returning nil if the batch is empty.
+func (b *Batch) Commit() error {
+	if len(b.cmds) == 0 {
+		return nil
+	}
+
+	return b.c.retryUntilExec(internal.Command_BatchCommand, internal.E_BatchCommand_Command,
+		&internal.BatchCommand{Commands: b.cmds},
+	)
+}
@@ -0,0 +1,93 @@
+package meta
+
+import (
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/influxdata/influxdb/services/meta"
+	"github.com/zhexuany/influxdb-cluster/meta/internal"
+)
+
+// newBatchTestFSM returns a storeFSM with just enough of *store filled
+// in for applyCreateDatabaseCommand (the command used below) to run
+// without touching raft.
+func newBatchTestFSM() *storeFSM {
+	return &storeFSM{
+		data:   &Data{Data: &meta.Data{}},
+		config: &MetaConfig{},
+	}
+}
+
+func TestStoreFSM_ApplyBatchCommand(t *testing.T) {
+	fsm := newBatchTestFSM()
+
+	batch := buildCommand(internal.Command_BatchCommand, internal.E_BatchCommand_Command,
+		&internal.BatchCommand{Commands: []*internal.Command{
+			buildCommand(internal.Command_CreateDatabaseCommand, internal.E_CreateDatabaseCommand_Command,
+				&internal.CreateDatabaseCommand{Name: proto.String("db0")}),
+			buildCommand(internal.Command_CreateDatabaseCommand, internal.E_CreateDatabaseCommand_Command,
+				&internal.CreateDatabaseCommand{Name: proto.String("db1")}),
+		}},
+	)
+
+	if result := fsm.applyBatchCommand(batch); result != nil {
+		t.Fatalf("applyBatchCommand: %v", result)
+	}
+
+	if fsm.data.Database("db0") == nil {
+		t.Fatal("expected db0 to have been created")
+	}
+	if fsm.data.Database("db1") == nil {
+		t.Fatal("expected db1 to have been created")
+	}
+}
+
+func TestStoreFSM_ApplyBatchCommand_StopsAtFirstError(t *testing.T) {
+	fsm := newBatchTestFSM()
+	if err := fsm.data.Data.CreateDatabase("db0"); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := buildCommand(internal.Command_BatchCommand, internal.E_BatchCommand_Command,
+		&internal.BatchCommand{Commands: []*internal.Command{
+			// db0 already exists, so this fails...
+			buildCommand(internal.Command_CreateDatabaseCommand, internal.E_CreateDatabaseCommand_Command,
+				&internal.CreateDatabaseCommand{Name: proto.String("db0")}),
+			// ...and this one, which would otherwise succeed, must never run.
+			buildCommand(internal.Command_CreateDatabaseCommand, internal.E_CreateDatabaseCommand_Command,
+				&internal.CreateDatabaseCommand{Name: proto.String("db1")}),
+		}},
+	)
+
+	if result := fsm.applyBatchCommand(batch); result == nil {
+		t.Fatal("expected applyBatchCommand to return the first command's error")
+	}
+
+	if fsm.data.Database("db1") != nil {
+		t.Fatal("db1 should not have been created after an earlier command in the batch failed")
+	}
+}
+
+func TestStoreFSM_ApplyBatchCommand_RollsBackEarlierSuccessOnLaterFailure(t *testing.T) {
+	fsm := newBatchTestFSM()
+
+	batch := buildCommand(internal.Command_BatchCommand, internal.E_BatchCommand_Command,
+		&internal.BatchCommand{Commands: []*internal.Command{
+			// This one succeeds on its own...
+			buildCommand(internal.Command_CreateDatabaseCommand, internal.E_CreateDatabaseCommand_Command,
+				&internal.CreateDatabaseCommand{Name: proto.String("db0")}),
+			// ...but a duplicate later in the same batch fails, so the
+			// whole batch must be rolled back, not left half-applied.
+			buildCommand(internal.Command_CreateDatabaseCommand, internal.E_CreateDatabaseCommand_Command,
+				&internal.CreateDatabaseCommand{Name: proto.String("db0")}),
+		}},
+	)
+
+	if result := fsm.applyBatchCommand(batch); result == nil {
+		t.Fatal("expected applyBatchCommand to return the duplicate-database error")
+	}
+
+	if fsm.data.Database("db0") != nil {
+		t.Fatal("db0 should not exist: the earlier command's effect must be rolled back when a later command in the same batch fails")
+	}
+}
@@ -0,0 +1,148 @@
+package meta
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/zhexuany/influxdb-cluster/tcp"
+)
+
+// ClusterSchemaVersion identifies the on-wire/meta-store schema this build
+// of the client understands. It is bumped whenever a change is made that
+// older meta servers can't safely service, so a rolling upgrade can detect
+// the mismatch instead of failing with an opaque protobuf error.
+const ClusterSchemaVersion = 1
+
+// Capability is a feature a meta server advertises support for during the
+// handshake performed in Client.Open. Feature-gated RPCs should check
+// Client.HasCapability before issuing a command so that a client talking to
+// a mixed-version cluster degrades predictably instead of sending a command
+// an older server can't decode.
+type Capability string
+
+const (
+	// CapabilityShardPendingOwners gates AddPendingShardOwner,
+	// CommitPendingShardOwner and RemovePendingShardOwner.
+	CapabilityShardPendingOwners Capability = "shard-pending-owners"
+
+	// CapabilityTSIIndex indicates the cluster supports the TSI index.
+	CapabilityTSIIndex Capability = "tsi-index"
+
+	// CapabilityAntiEntropy indicates the cluster runs the anti-entropy
+	// shard repair service.
+	CapabilityAntiEntropy Capability = "anti-entropy"
+
+	// CapabilityTLSMux indicates the meta servers accept TLS-wrapped
+	// connections on the muxed TCP transport.
+	CapabilityTLSMux Capability = "tls-mux"
+)
+
+// ErrCapabilityUnavailable is returned by feature-gated Client methods when
+// the negotiated capability set for the cluster doesn't include the
+// capability the method requires, e.g. because one or more meta servers
+// haven't been upgraded yet.
+var ErrCapabilityUnavailable = errors.New("meta: capability unavailable on this cluster")
+
+// handshakeRequest is exchanged with every configured meta server when the
+// client opens. It is encoded as JSON rather than through the internal
+// protobuf command set since it isn't a raft command - it never gets
+// applied to the FSM, just replied to by whichever server accepts it.
+type handshakeRequest struct {
+	SchemaVersion int `json:"schema_version"`
+}
+
+type handshakeResponse struct {
+	SchemaVersion int      `json:"schema_version"`
+	Capabilities  []string `json:"capabilities"`
+}
+
+// HasCapability reports whether the cluster this client is connected to has
+// negotiated support for cap.
+func (c *Client) HasCapability(cap Capability) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.capabilities[cap]
+}
+
+// negotiateCapabilities exchanges the local schema version with every known
+// meta server and records the intersection of capabilities they all
+// advertise. It is best-effort: a server that can't be reached or doesn't
+// understand the handshake is simply skipped rather than failing Open, so
+// that a single straggler doesn't prevent the client from starting.
+func (c *Client) negotiateCapabilities() error {
+	servers := c.MetaServers()
+	if len(servers) == 0 {
+		return nil
+	}
+
+	negotiated := make(map[Capability]bool)
+	reached := 0
+	for i, addr := range servers {
+		caps, err := c.handshake(addr)
+		if err != nil {
+			c.Logger().Printf("capability handshake with %s failed: %s", addr, err)
+			continue
+		}
+
+		if i == 0 || reached == 0 {
+			for _, cp := range caps {
+				negotiated[Capability(cp)] = true
+			}
+		} else {
+			for cp := range negotiated {
+				if !containsString(caps, string(cp)) {
+					delete(negotiated, cp)
+				}
+			}
+		}
+		reached++
+	}
+
+	c.mu.Lock()
+	c.capabilities = negotiated
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (c *Client) handshake(addr string) ([]string, error) {
+	conn, err := (&tcp.Dialer{Header: tcp.MuxRPCHeader, TLSConfig: c.tlsConfig}).Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	req, err := json.Marshal(handshakeRequest{SchemaVersion: ClusterSchemaVersion})
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFrame(conn, req); err != nil {
+		return nil, err
+	}
+
+	b, err := readFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp handshakeResponse
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return nil, err
+	}
+
+	if resp.SchemaVersion > ClusterSchemaVersion {
+		return nil, fmt.Errorf("meta server %s is running a newer schema version (%d > %d)", addr, resp.SchemaVersion, ClusterSchemaVersion)
+	}
+
+	return resp.Capabilities, nil
+}
+
+func containsString(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -2,6 +2,8 @@ package meta
 
 import (
 	"bytes"
+	"crypto/tls"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,6 +15,7 @@ import (
 	"net/http"
 	"os"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -20,9 +23,9 @@ import (
 	"github.com/influxdata/influxdb/influxql"
 	"github.com/influxdata/influxdb/services/meta"
 	"github.com/zhexuany/influxdb-cluster/meta/internal"
+	"github.com/zhexuany/influxdb-cluster/tcp"
 
 	"github.com/gogo/protobuf/proto"
-	"golang.org/x/crypto/bcrypt"
 	"path/filepath"
 )
 
@@ -36,6 +39,15 @@ const (
 	maxRetries = 10
 
 	metaFile = "meta.db"
+
+	// commandLenSize is the size, in bytes, of the length prefix written
+	// before every protobuf-encoded command/response on the wire.
+	commandLenSize = 8
+
+	// notLeaderErrorPrefix is prepended to the error string a meta server
+	// returns when it can't service a command because it isn't the raft
+	// leader; the remainder of the string is the leader's address.
+	notLeaderErrorPrefix = "not leader: "
 )
 
 var (
@@ -59,37 +71,128 @@ type Client struct {
 	HTTPClient  *http.Client
 	metaServers []string
 
-	// Authentication cache.
-	authCache map[string]authUser
-	authInfo  string
+	// pool is the set of pooled, muxed TCP connections used for
+	// retryUntilExec/retryUntilSnapshot traffic instead of opening a new
+	// HTTP request per call.
+	pool      *tcp.Pool
+	tlsConfig *tls.Config
+
+	// Authentication cache, bounded by MetaConfig.AuthCacheSize.
+	authCache      *authCacheLRU
+	authInfo       string
+	passwordHasher PasswordHasher
 
 	path string
 
 	retentionAutoCreate bool
 
+	// defaultReplicaN overrides the replication factor used for
+	// auto-created retention policies when > 0. See SetDefaultReplication.
+	defaultReplicaN int
+
 	tls bool
 
 	nodeID uint64
 
 	config *MetaConfig
+
+	// capabilities is the set of features negotiated with every
+	// metaServer during Open, used to gate RPCs on mixed-version
+	// clusters. See negotiateCapabilities.
+	capabilities map[Capability]bool
+
+	// localStore is set when this client is co-located with an embedded
+	// meta Store, e.g. when running on a meta node itself. retryUntilExec
+	// applies commands directly to it when it's the raft leader, avoiding
+	// a network hop to a remote meta server.
+	localStore *Store
+
+	// wal is the durable, on-disk log of commands submitted via
+	// retryUntilExec that haven't yet been confirmed committed. See
+	// wal.go and Client.RecoverPending.
+	wal *commandWAL
+
+	// healthTracker maintains a leader-first preference list of
+	// metaServers, built from periodic /status health checks plus
+	// redirect/error feedback from retryUntilExec and
+	// retryUntilSnapshot. See health.go.
+	healthTracker *metaServerTracker
+
+	// consistencyMode is the default read consistency parsed from
+	// MetaConfig.ConsistencyMode. See consistency.go.
+	consistencyMode ConsistencyMode
+}
+
+// ConsistencyMode returns the client's default read consistency, set via
+// MetaConfig.ConsistencyMode.
+func (c *Client) ConsistencyMode() ConsistencyMode {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.consistencyMode
+}
+
+// SetStore associates an in-process meta Store with the client. Commands
+// are applied directly to s whenever s is the raft leader, instead of being
+// sent over the network to a metaServer.
+func (c *Client) SetStore(s *Store) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.localStore = s
 }
 
 // NewClient returns a new *Client.
 func NewClient(config *MetaConfig) *Client {
-	return &Client{
+	c := &Client{
 		changed:             make(chan struct{}),
 		closing:             make(chan struct{}),
 		cacheData:           &Data{},
 		logger:              log.New(os.Stderr, "[metaclient] ", log.LstdFlags),
-		authCache:           make(map[string]authUser, 0),
+		authCache:           newAuthCacheLRU(config.AuthCacheSize),
+		passwordHasher:      NewBCryptPasswordHasher(0),
 		path:                config.Dir,
 		retentionAutoCreate: config.RetentionAutoCreate,
 		config:              config,
 	}
+	c.pool = tcp.NewPool(&tcp.Dialer{Header: tcp.MuxExecHeader})
+	c.healthTracker = newMetaServerTracker()
+
+	mode, err := ParseConsistencyMode(config.ConsistencyMode)
+	if err != nil {
+		c.logger.Printf("invalid consistency mode %q, defaulting to eventual: %s", config.ConsistencyMode, err.Error())
+	}
+	c.consistencyMode = mode
+
+	wal, err := openCommandWAL(config.Dir)
+	if err != nil {
+		c.logger.Printf("failed to open command WAL, writes will not survive a restart: %s", err.Error())
+		wal = &commandWAL{nextRequestNum: 1}
+	}
+	c.wal = wal
+
+	return c
+}
+
+// SetPasswordHasher sets the PasswordHasher used to hash new and updated
+// user passwords. It does not affect existing users' stored hashes, which
+// continue to be verified with whichever PasswordHasher produced them (see
+// passwordHasherForHash), so switching algorithms is safe on a live
+// cluster.
+func (c *Client) SetPasswordHasher(h PasswordHasher) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.passwordHasher = h
+}
+
+// SetTLSConfig sets the TLS config used by the client's connection pool
+// dialer so pooled connections are wrapped in a TLS handshake with mutual
+// auth, matching the TLS setting configured on the meta servers.
+func (c *Client) SetTLSConfig(cfg *tls.Config) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tlsConfig = cfg
+	c.pool.Dialer.TLSConfig = cfg
 }
 
-//
-//
 // Open a connection to a meta service cluster.
 func (c *Client) Open() error {
 	if c.closed() {
@@ -108,6 +211,12 @@ func (c *Client) Open() error {
 		return nil
 	}
 
+	if err := c.negotiateCapabilities(); err != nil {
+		c.Logger().Println("failed to negotiate capabilities with meta servers")
+	}
+
+	c.healthTracker.start(c.MetaServers())
+
 	c.mu.Lock()
 	c.changed = make(chan struct{})
 	c.mu.Unlock()
@@ -125,6 +234,10 @@ func (c *Client) Open() error {
 		c.Logger().Println("failed to updated meta servers")
 	}
 
+	if err := c.replayPending(); err != nil {
+		c.Logger().Printf("failed to replay pending WAL commands: %s", err.Error())
+	}
+
 	//TODO may be a goroutine here
 	c.Logger().Println("")
 
@@ -152,6 +265,8 @@ func (c *Client) Close() error {
 		close(c.closing)
 	}
 
+	c.healthTracker.stop()
+
 	return nil
 }
 
@@ -384,6 +499,42 @@ func (c *Client) ClusterID() uint64 {
 	return c.data().Data.ClusterID
 }
 
+// ImportMeta restores or merges the exported payload read from r (see
+// Data.ExportSnapshot/ExportForMerge) into the cluster, according to
+// opts. Because store.Apply only ever returns an error back through
+// raft (see store.go), the returned ImportResult is computed locally
+// against the client's own cached Data rather than threaded back
+// through the raft response; a DryRun never proposes a command at all,
+// since there's nothing to replicate.
+func (c *Client) ImportMeta(r io.Reader, opts ImportOptions) (*ImportResult, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	preview := c.data().Clone()
+	result, err := preview.Import(buf, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.DryRun {
+		return result, nil
+	}
+
+	cmd := &internal.ImportDataCommand{
+		Data:        buf,
+		Merge:       proto.Bool(opts.Merge),
+		MergePolicy: proto.Int32(int32(opts.MergePolicy)),
+		DryRun:      proto.Bool(false),
+		Force:       proto.Bool(opts.Force),
+	}
+	if err := c.retryUntilExec(internal.Command_ImportDataCommand, internal.E_ImportDataCommand_Command, cmd); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
 // Node returns a node by id.
 func (c *Client) DataNode(id uint64) (*NodeInfo, error) {
 	for _, n := range c.data().DataNodes {
@@ -431,7 +582,24 @@ func (c *Client) ShardPendingOwners() uint64arr {
 	return uint64arr{}
 }
 
+func (c *Client) AddPendingShardOwner(id, nodeid uint64) error {
+	if !c.HasCapability(CapabilityShardPendingOwners) {
+		return ErrCapabilityUnavailable
+	}
+
+	cmd := &internal.AddPendingShardOwnerCommand{
+		ID:     proto.Uint64(id),
+		NodeID: proto.Uint64(nodeid),
+	}
+
+	return c.retryUntilExec(internal.Command_AddPendingShardOwnerCommand, internal.E_AddPendingShardOwnerCommand_Command, cmd)
+}
+
 func (c *Client) RemovePendingShardOwner(id, nodeid uint64) error {
+	if !c.HasCapability(CapabilityShardPendingOwners) {
+		return ErrCapabilityUnavailable
+	}
+
 	cmd := &internal.RemovePendingShardOwnerCommand{
 		ID:     proto.Uint64(id),
 		NodeID: proto.Uint64(nodeid),
@@ -441,6 +609,10 @@ func (c *Client) RemovePendingShardOwner(id, nodeid uint64) error {
 }
 
 func (c *Client) CommitPendingShardOwner(id, nodeid uint64) error {
+	if !c.HasCapability(CapabilityShardPendingOwners) {
+		return ErrCapabilityUnavailable
+	}
+
 	cmd := &internal.CommitPendingShardOwnerCommand{
 		ID:     proto.Uint64(id),
 		NodeID: proto.Uint64(nodeid),
@@ -464,7 +636,7 @@ func (c *Client) RemoveShardOwner(id, nodeid uint64) error {
 		NodeID: proto.Uint64(nodeid),
 	}
 
-	return c.retryUntilExec(internal.Command_RemoveShardOwnerCommand, internal.E_AddShardOwnerCommand_Command, cmd)
+	return c.retryUntilExec(internal.Command_RemoveShardOwnerCommand, internal.E_RemoveShardOwnerCommand_Command, cmd)
 }
 
 func (c *Client) UpdateDataNode(id uint64, host, tcpHost string) error {
@@ -559,6 +731,25 @@ func (c *Client) Databases() ([]meta.DatabaseInfo, error) {
 	return dbs, nil
 }
 
+// SetDefaultReplication overrides the replication factor used for
+// auto-created retention policies in CreateDatabase; 0 restores the
+// default policy of min(live data nodes, maxAutoCreatedReplicaN).
+func (c *Client) SetDefaultReplication(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.defaultReplicaN = n
+}
+
+// maxAutoCreatedReplicaN returns the configured cap on the replication
+// factor chosen for auto-created retention policies, defaulting to
+// maxAutoCreatedRetentionPolicyReplicaN when the config doesn't override it.
+func (c *Client) maxAutoCreatedReplicaN() int {
+	if c.config != nil && c.config.MaxAutoCreatedReplicaN > 0 {
+		return c.config.MaxAutoCreatedReplicaN
+	}
+	return maxAutoCreatedRetentionPolicyReplicaN
+}
+
 func (c *Client) defaultRetentionPolicyInfo(name string, duration time.Duration) *meta.RetentionPolicyInfo {
 	// Retrieve all data nodes from cluster
 	nis, err := c.DataNodes()
@@ -566,14 +757,21 @@ func (c *Client) defaultRetentionPolicyInfo(name string, duration time.Duration)
 		return nil
 	}
 
-	replicaN := 0
-	if len(nis) < 3 {
-		replicaN = 3
-	} else if len(nis) > 1 {
+	c.mu.RLock()
+	override := c.defaultReplicaN
+	c.mu.RUnlock()
+
+	replicaN := override
+	if replicaN <= 0 {
 		replicaN = len(nis)
-	} else if len(nis) < 1 {
+		if max := c.maxAutoCreatedReplicaN(); replicaN > max {
+			replicaN = max
+		}
+	}
+	if replicaN < 1 {
 		replicaN = 1
 	}
+
 	return &meta.RetentionPolicyInfo{
 		Name:     name,
 		ReplicaN: replicaN,
@@ -581,6 +779,22 @@ func (c *Client) defaultRetentionPolicyInfo(name string, duration time.Duration)
 	}
 }
 
+// checkReplicaN returns ErrReplicationFactorTooHigh if replicaN is set and
+// exceeds the number of live data nodes in the cluster.
+func (c *Client) checkReplicaN(replicaN *int) error {
+	if replicaN == nil {
+		return nil
+	}
+	nis, err := c.DataNodes()
+	if err != nil {
+		return err
+	}
+	if *replicaN > len(nis) {
+		return ErrReplicationFactorTooHigh
+	}
+	return nil
+}
+
 // CreateDatabase creates a database or returns it if it already exists
 func (c *Client) CreateDatabase(name string) (*meta.DatabaseInfo, error) {
 	if db, _ := c.Database(name); db != nil {
@@ -616,6 +830,10 @@ func (c *Client) CreateDatabaseWithRetentionPolicy(name string, spec *meta.Reten
 		return nil, ErrRetentionPolicyDurationTooLow
 	}
 
+	if err := c.checkReplicaN(spec.ReplicaN); err != nil {
+		return nil, err
+	}
+
 	if db, _ := c.Database(name); db != nil {
 		// Check if the retention policy already exists. If it does and matches
 		// the desired retention policy, exit with no error.
@@ -677,6 +895,10 @@ func (c *Client) CreateRetentionPolicy(database string, spec *meta.RetentionPoli
 		return nil, ErrRetentionPolicyDurationTooLow
 	}
 
+	if err := c.checkReplicaN(spec.ReplicaN); err != nil {
+		return nil, err
+	}
+
 	//TODO have to figure why do this
 	_, err := spec.MarshalBinary()
 	if err != nil {
@@ -791,10 +1013,6 @@ func (c *Client) User(name string) (*UserInfo, error) {
 	return nil, ErrUserNotFound
 }
 
-// bcryptCost is the cost associated with generating password with bcrypt.
-// This setting is lowered during testing to improve test suite performance.
-var bcryptCost = bcrypt.DefaultCost
-
 func (c *Client) toOSUser() {}
 
 func (c *Client) CreateUser(name, password string, admin bool) (*UserInfo, error) {
@@ -802,14 +1020,20 @@ func (c *Client) CreateUser(name, password string, admin bool) (*UserInfo, error
 
 	// See if the user already exists.
 	if u := data.User(name); u != nil {
-		if err := bcrypt.CompareHashAndPassword([]byte(u.Hash), []byte(password)); err != nil || u.Admin != admin {
+		if err := passwordHasherForHash([]byte(u.Hash)).Compare([]byte(u.Hash), password); err != nil || u.Admin != admin {
 			return nil, ErrUserExists
 		}
 		return u, nil
 	}
 
-	// Hash the password before serializing it.
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	// Hash the password with the configured PasswordHasher before
+	// serializing it; the hash is self-tagged so it can be verified by
+	// the right hasher even after the cluster's default changes.
+	c.mu.RLock()
+	hasher := c.passwordHasher
+	c.mu.RUnlock()
+
+	hash, err := hasher.Hash(password)
 	if err != nil {
 		return nil, err
 	}
@@ -827,26 +1051,49 @@ func (c *Client) CreateUser(name, password string, admin bool) (*UserInfo, error
 }
 
 func (c *Client) UpdateUser(name, password string) error {
+	c.mu.RLock()
+	hasher := c.passwordHasher
+	c.mu.RUnlock()
+
 	// Hash the password before serializing it.
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	hash, err := hasher.Hash(password)
 	if err != nil {
 		return err
 	}
 
-	return c.retryUntilExec(internal.Command_UpdateUserCommand, internal.E_UpdateUserCommand_Command,
+	if err := c.retryUntilExec(internal.Command_UpdateUserCommand, internal.E_UpdateUserCommand_Command,
 		&internal.UpdateUserCommand{
 			Name: proto.String(name),
 			Hash: proto.String(string(hash)),
 		},
-	)
+	); err != nil {
+		return err
+	}
+
+	// The old hash is no longer valid, so the cached entry (keyed off it)
+	// must go; otherwise a revoked or changed password could keep
+	// authenticating against the stale cache until it naturally evicts.
+	c.mu.Lock()
+	c.authCache.delete(name)
+	c.mu.Unlock()
+
+	return nil
 }
 
 func (c *Client) DropUser(name string) error {
-	return c.retryUntilExec(internal.Command_DropUserCommand, internal.E_DropUserCommand_Command,
+	if err := c.retryUntilExec(internal.Command_DropUserCommand, internal.E_DropUserCommand_Command,
 		&internal.DropUserCommand{
 			Name: proto.String(name),
 		},
-	)
+	); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.authCache.delete(name)
+	c.mu.Unlock()
+
+	return nil
 }
 
 func (c *Client) SetPrivilege(username, database string, p influxql.Privilege) error {
@@ -860,28 +1107,45 @@ func (c *Client) SetPrivilege(username, database string, p influxql.Privilege) e
 }
 
 func (c *Client) SetAdminPrivilege(username string, admin bool) error {
-	return c.retryUntilExec(internal.Command_SetAdminPrivilegeCommand, internal.E_SetAdminPrivilegeCommand_Command,
+	if err := c.retryUntilExec(internal.Command_SetAdminPrivilegeCommand, internal.E_SetAdminPrivilegeCommand_Command,
 		&internal.SetAdminPrivilegeCommand{
 			Username: proto.String(username),
 			Admin:    proto.Bool(admin),
 		},
-	)
+	); err != nil {
+		return err
+	}
+
+	// Force re-authentication under the new privilege the next time this
+	// user authenticates, rather than serving a cached verdict that
+	// predates the privilege change.
+	c.mu.Lock()
+	c.authCache.delete(username)
+	c.mu.Unlock()
+
+	return nil
 }
 
 // TODO revisite this later
 func (c *Client) updateUserPermissions() {
 }
 
+// UserPrivileges returns every database username has a privilege on,
+// the union of their direct grants and whatever their role memberships
+// grant (see Data.UserPrivileges).
 func (c *Client) UserPrivileges(username string) (map[string]influxql.Privilege, error) {
-	p, err := c.data().Data.UserPrivileges(username)
+	p, err := c.data().UserPrivileges(username)
 	if err != nil {
 		return nil, err
 	}
 	return p, nil
 }
 
+// UserPrivilege returns username's effective privilege on database: the
+// higher of their direct grant and whatever their role memberships
+// grant (see Data.UserPrivilege).
 func (c *Client) UserPrivilege(username, database string) (*influxql.Privilege, error) {
-	p, err := c.data().Data.UserPrivilege(username, database)
+	p, err := c.data().UserPrivilege(username, database)
 	if err != nil {
 		return nil, err
 	}
@@ -907,18 +1171,23 @@ func (c *Client) Authenticate(username, password string) (*UserInfo, error) {
 		return nil, ErrUserNotFound
 	}
 
-	// Check the local auth cache first.
-	if au, ok := c.authCache[username]; ok {
+	// Check the local auth cache first, as long as the cached entry was
+	// built from the user's current hash (it's evicted on any change, but
+	// this also catches a command that changed the hash out from under an
+	// otherwise-untouched cache entry).
+	if au, ok := c.authCache.get(username); ok && au.bhash == userInfo.Hash {
 		// verify the password using the cached salt and hash
 		if bytes.Equal(hashWithSalt(au.salt, password), au.hash) {
 			return userInfo, nil
 		}
 
-		// fall through to requiring a full bcrypt hash for invalid passwords
+		// fall through to requiring a full, configured-hasher comparison
+		// for invalid passwords
 	}
 
-	// Compare password with user hash.
-	if err := bcrypt.CompareHashAndPassword([]byte(userInfo.Hash), []byte(password)); err != nil {
+	// Compare password with user hash, using whichever PasswordHasher
+	// produced it.
+	if err := passwordHasherForHash([]byte(userInfo.Hash)).Compare([]byte(userInfo.Hash), password); err != nil {
 		return nil, ErrAuthenticate
 	}
 
@@ -927,7 +1196,7 @@ func (c *Client) Authenticate(username, password string) (*UserInfo, error) {
 	if err != nil {
 		return nil, err
 	}
-	c.authCache[username] = authUser{salt: salt, hash: hashed, bhash: userInfo.Hash}
+	c.authCache.set(username, authUser{salt: salt, hash: hashed, bhash: userInfo.Hash})
 
 	return userInfo, nil
 }
@@ -1026,6 +1295,23 @@ func (c *Client) CreateShardGroup(database, policy string, timestamp time.Time)
 	return rpi.ShardGroupByTimestamp(timestamp), nil
 }
 
+// CreateShardGroupIn appends a CreateShardGroup command to batch instead
+// of executing it immediately, for precreating shard groups across many
+// retention policies in one raft proposal. Unlike CreateShardGroup, it
+// doesn't look up or return the resulting *meta.ShardGroupInfo, since
+// that isn't available until batch.Commit applies the command; callers
+// needing it should look it up themselves afterwards, e.g. via
+// RetentionPolicy(database, policy).ShardGroupByTimestamp(timestamp).
+func (c *Client) CreateShardGroupIn(batch *Batch, database, policy string, timestamp time.Time) {
+	batch.add(internal.Command_CreateShardGroupCommand, internal.E_CreateShardGroupCommand_Command,
+		&internal.CreateShardGroupCommand{
+			Database:  proto.String(database),
+			Policy:    proto.String(policy),
+			Timestamp: proto.Int64(timestamp.UnixNano()),
+		},
+	)
+}
+
 // DeleteShardGroup removes a shard group from a database and retention policy by id.
 func (c *Client) DeleteShardGroup(database, policy string, id uint64) error {
 	cmd := &internal.DeleteShardGroupCommand{
@@ -1037,6 +1323,48 @@ func (c *Client) DeleteShardGroup(database, policy string, id uint64) error {
 	return c.retryUntilExec(internal.Command_DeleteShardGroupCommand, internal.E_DeleteShardGroupCommand_Command, cmd)
 }
 
+// CreateBalancedShardGroup is CreateShardGroup's counterpart for
+// rebalance and decommission work: see Data.CreateBalancedShardGroup.
+func (c *Client) CreateBalancedShardGroup(database, policy string, timestamp time.Time) (*meta.ShardGroupInfo, error) {
+	if sg, _ := c.data().Data.ShardGroupByTimestamp(database, policy, timestamp); sg != nil {
+		return sg, nil
+	}
+
+	cmd := &internal.CreateBalancedShardGroupCommand{
+		Database:  proto.String(database),
+		Policy:    proto.String(policy),
+		Timestamp: proto.Int64(timestamp.UnixNano()),
+	}
+
+	if err := c.retryUntilExec(internal.Command_CreateBalancedShardGroupCommand, internal.E_CreateBalancedShardGroupCommand_Command, cmd); err != nil {
+		return nil, err
+	}
+
+	rpi, err := c.RetentionPolicy(database, policy)
+	if err != nil {
+		return nil, err
+	} else if rpi == nil {
+		return nil, errors.New("retention policy deleted after shard group created")
+	}
+
+	return rpi.ShardGroupByTimestamp(timestamp), nil
+}
+
+// TruncateShardGroups pulls in the EndTime of every shard group covering
+// timestamp in database/policy, so no write after timestamp lands in a
+// group that's being moved or decommissioned (see Data.TruncateShardsGrops).
+// CreateShardGroup/CreateBalancedShardGroup will open a fresh group to
+// take over once the truncated one's EndTime passes.
+func (c *Client) TruncateShardGroups(database, policy string, timestamp time.Time) error {
+	cmd := &internal.TruncateShardGroupsCommand{
+		Database:  proto.String(database),
+		Policy:    proto.String(policy),
+		Timestamp: proto.Int64(timestamp.UnixNano()),
+	}
+
+	return c.retryUntilExec(internal.Command_TruncateShardGroupsCommand, internal.E_TruncateShardGroupsCommand_Command, cmd)
+}
+
 // PrecreateShardGroups creates shard groups whose endtime is before the 'to' time passed in, but
 // is yet to expire before 'from'. This is to avoid the need for these shards to be created when data
 // for the corresponding time range arrives. Shard creation involves Raft consensus, and precreation
@@ -1176,52 +1504,112 @@ func (c *Client) CreateMetaNode(httpAddr, tcpAddr string) (*NodeInfo, error) {
 }
 
 func (c *Client) DeleteMetaNode(id uint64) error {
+	return c.DeleteMetaNodeIn(nil, id)
+}
+
+// DeleteMetaNodeIn is DeleteMetaNode, except that when batch is non-nil
+// the command is appended to it instead of being executed immediately;
+// see Client.Batch.
+func (c *Client) DeleteMetaNodeIn(batch *Batch, id uint64) error {
 	cmd := &internal.DeleteMetaNodeCommand{
 		ID: proto.Uint64(id),
 	}
 
+	if batch != nil {
+		batch.add(internal.Command_DeleteMetaNodeCommand, internal.E_DeleteMetaNodeCommand_Command, cmd)
+		return nil
+	}
+
 	return c.retryUntilExec(internal.Command_DeleteMetaNodeCommand, internal.E_DeleteMetaNodeCommand_Command, cmd)
 }
 
 func (c *Client) CreateContinuousQuery(database, name, query string) error {
-	return c.retryUntilExec(internal.Command_CreateContinuousQueryCommand, internal.E_CreateContinuousQueryCommand_Command,
-		&internal.CreateContinuousQueryCommand{
-			Database: proto.String(database),
-			Name:     proto.String(name),
-			Query:    proto.String(query),
-		},
-	)
+	return c.CreateContinuousQueryIn(nil, database, name, query)
+}
+
+// CreateContinuousQueryIn is CreateContinuousQuery, except that when
+// batch is non-nil the command is appended to it instead of being
+// executed immediately; see Client.Batch.
+func (c *Client) CreateContinuousQueryIn(batch *Batch, database, name, query string) error {
+	cmd := &internal.CreateContinuousQueryCommand{
+		Database: proto.String(database),
+		Name:     proto.String(name),
+		Query:    proto.String(query),
+	}
+
+	if batch != nil {
+		batch.add(internal.Command_CreateContinuousQueryCommand, internal.E_CreateContinuousQueryCommand_Command, cmd)
+		return nil
+	}
+
+	return c.retryUntilExec(internal.Command_CreateContinuousQueryCommand, internal.E_CreateContinuousQueryCommand_Command, cmd)
 }
 
 func (c *Client) DropContinuousQuery(database, name string) error {
-	return c.retryUntilExec(internal.Command_DropContinuousQueryCommand, internal.E_DropContinuousQueryCommand_Command,
-		&internal.DropContinuousQueryCommand{
-			Database: proto.String(database),
-			Name:     proto.String(name),
-		},
-	)
+	return c.DropContinuousQueryIn(nil, database, name)
+}
+
+// DropContinuousQueryIn is DropContinuousQuery, except that when batch is
+// non-nil the command is appended to it instead of being executed
+// immediately; see Client.Batch.
+func (c *Client) DropContinuousQueryIn(batch *Batch, database, name string) error {
+	cmd := &internal.DropContinuousQueryCommand{
+		Database: proto.String(database),
+		Name:     proto.String(name),
+	}
+
+	if batch != nil {
+		batch.add(internal.Command_DropContinuousQueryCommand, internal.E_DropContinuousQueryCommand_Command, cmd)
+		return nil
+	}
+
+	return c.retryUntilExec(internal.Command_DropContinuousQueryCommand, internal.E_DropContinuousQueryCommand_Command, cmd)
 }
 
 func (c *Client) CreateSubscription(database, rp, name, mode string, destinations []string) error {
-	return c.retryUntilExec(internal.Command_CreateSubscriptionCommand, internal.E_CreateSubscriptionCommand_Command,
-		&internal.CreateSubscriptionCommand{
-			Database:        proto.String(database),
-			RetentionPolicy: proto.String(rp),
-			Name:            proto.String(name),
-			Mode:            proto.String(mode),
-			Destinations:    destinations,
-		},
-	)
+	return c.CreateSubscriptionIn(nil, database, rp, name, mode, destinations)
+}
+
+// CreateSubscriptionIn is CreateSubscription, except that when batch is
+// non-nil the command is appended to it instead of being executed
+// immediately; see Client.Batch.
+func (c *Client) CreateSubscriptionIn(batch *Batch, database, rp, name, mode string, destinations []string) error {
+	cmd := &internal.CreateSubscriptionCommand{
+		Database:        proto.String(database),
+		RetentionPolicy: proto.String(rp),
+		Name:            proto.String(name),
+		Mode:            proto.String(mode),
+		Destinations:    destinations,
+	}
+
+	if batch != nil {
+		batch.add(internal.Command_CreateSubscriptionCommand, internal.E_CreateSubscriptionCommand_Command, cmd)
+		return nil
+	}
+
+	return c.retryUntilExec(internal.Command_CreateSubscriptionCommand, internal.E_CreateSubscriptionCommand_Command, cmd)
 }
 
 func (c *Client) DropSubscription(database, rp, name string) error {
-	return c.retryUntilExec(internal.Command_DropSubscriptionCommand, internal.E_DropSubscriptionCommand_Command,
-		&internal.DropSubscriptionCommand{
-			Database:        proto.String(database),
-			RetentionPolicy: proto.String(rp),
-			Name:            proto.String(name),
-		},
-	)
+	return c.DropSubscriptionIn(nil, database, rp, name)
+}
+
+// DropSubscriptionIn is DropSubscription, except that when batch is
+// non-nil the command is appended to it instead of being executed
+// immediately; see Client.Batch.
+func (c *Client) DropSubscriptionIn(batch *Batch, database, rp, name string) error {
+	cmd := &internal.DropSubscriptionCommand{
+		Database:        proto.String(database),
+		RetentionPolicy: proto.String(rp),
+		Name:            proto.String(name),
+	}
+
+	if batch != nil {
+		batch.add(internal.Command_DropSubscriptionCommand, internal.E_DropSubscriptionCommand_Command, cmd)
+		return nil
+	}
+
+	return c.retryUntilExec(internal.Command_DropSubscriptionCommand, internal.E_DropSubscriptionCommand_Command, cmd)
 }
 
 func (c *Client) Data() *Data {
@@ -1268,12 +1656,63 @@ func (c *Client) index() uint64 {
 }
 
 // retryUntilExec will attempt the command on each of the metaservers until it either succeeds or
-// hits the max number of tries
+// hits the max number of tries. The command is first appended to the
+// client's WAL (see wal.go) so it survives a client restart or a meta
+// cluster outage; replayPending resubmits it the same way on the next
+// startup if the process dies before it's marked committed.
 func (c *Client) retryUntilExec(typ internal.Command_Type, desc *proto.ExtensionDesc, value interface{}) error {
+	cmd := buildCommand(typ, desc, value)
+
+	reqNum, err := c.wal.append(cmd)
+	if err != nil {
+		c.Logger().Printf("failed to append command to WAL: %s", err.Error())
+	}
+
+	return c.submitCommand(cmd, reqNum)
+}
+
+// marshalCommand marshals cmd for the wire. If c.config.SigningKey is
+// set, cmd is instead wrapped in a signed envelope (see signCommand) so
+// a store with TrustedKeys configured can verify and audit it; nil, the
+// default, sends the plain unsigned command exactly as before signing
+// existed.
+func (c *Client) marshalCommand(cmd *internal.Command) ([]byte, error) {
+	if c.config != nil && c.config.SigningKey != nil {
+		return signCommand(cmd, c.config.SigningKey)
+	}
+	return proto.Marshal(cmd)
+}
+
+// submitCommand sends cmd to the raft leader, either directly via a
+// co-located localStore or by retrying against each metaserver in turn,
+// and marks reqNum committed in the WAL once a raft index is obtained.
+func (c *Client) submitCommand(cmd *internal.Command, reqNum uint64) error {
+	c.mu.RLock()
+	local := c.localStore
+	c.mu.RUnlock()
+
+	if local != nil && local.IsLeader() {
+		b, err := c.marshalCommand(cmd)
+		if err != nil {
+			return err
+		}
+
+		if err := local.Apply(b); err != nil {
+			return err
+		}
+
+		idx := c.index()
+		if err := c.wal.markCommitted(reqNum); err != nil {
+			c.Logger().Printf("failed to mark WAL request %d committed: %s", reqNum, err.Error())
+		}
+		c.waitForIndex(idx)
+		return nil
+	}
+
 	var err error
 	var index uint64
 	tries := 0
-	currentServer := 0
+	preferred := c.healthTracker.preferred()
 	var redirectServer string
 
 	for {
@@ -1288,32 +1727,31 @@ func (c *Client) retryUntilExec(typ internal.Command_Type, desc *proto.Extension
 		}
 		c.mu.RUnlock()
 
-		// build the url to hit the redirect server or the next metaserver
-		var url string
+		// Pick the redirect target if we have one, otherwise start from
+		// the cached leader/healthiest node instead of round-robining
+		// through every server.
+		var addr string
 		if redirectServer != "" {
-			url = redirectServer
+			addr = redirectServer
 			redirectServer = ""
 		} else {
-			c.mu.RLock()
-			if currentServer >= len(c.metaServers) {
-				currentServer = 0
+			if len(preferred) == 0 {
+				preferred = c.healthTracker.preferred()
 			}
-			server := c.metaServers[currentServer]
-			c.mu.RUnlock()
-
-			url = fmt.Sprintf("://%s/execute", server)
-			if c.tls {
-				url = "https" + url
-			} else {
-				url = "http" + url
+			if len(preferred) == 0 {
+				return ErrServiceUnavailable
 			}
+			addr, preferred = preferred[0], preferred[1:]
 		}
 
-		index, err = c.exec(url, typ, desc, value)
+		index, err = c.execCommand(addr, cmd)
 		tries++
-		currentServer++
 
 		if err == nil {
+			c.healthTracker.promote(addr)
+			if err := c.wal.markCommitted(reqNum); err != nil {
+				c.Logger().Printf("failed to mark WAL request %d committed: %s", reqNum, err.Error())
+			}
 			c.waitForIndex(index)
 			return nil
 		}
@@ -1323,6 +1761,8 @@ func (c *Client) retryUntilExec(typ internal.Command_Type, desc *proto.Extension
 		}
 
 		if e, ok := err.(errRedirect); ok {
+			c.healthTracker.demote(addr, err)
+			c.healthTracker.promote(e.host)
 			redirectServer = e.host
 			continue
 		}
@@ -1331,47 +1771,50 @@ func (c *Client) retryUntilExec(typ internal.Command_Type, desc *proto.Extension
 			return err
 		}
 
+		c.healthTracker.demote(addr, err)
 		time.Sleep(errSleep)
 	}
 }
 
-func (c *Client) exec(url string, typ internal.Command_Type, desc *proto.ExtensionDesc, value interface{}) (index uint64, err error) {
-	// Create command.
-	cmd := &internal.Command{Type: &typ}
-	if err := proto.SetExtension(cmd, desc, value); err != nil {
-		panic(err)
-	}
-
-	b, err := proto.Marshal(cmd)
+// execCommand sends cmd to addr over a pooled muxed TCP connection and
+// returns the resulting raft index. Commands are framed as an 8-byte
+// big-endian length prefix followed by the marshaled internal.Command
+// protobuf; the response is framed the same way.
+func (c *Client) execCommand(addr string, cmd *internal.Command) (index uint64, err error) {
+	b, err := c.marshalCommand(cmd)
 	if err != nil {
 		return 0, err
 	}
 
-	resp, err := http.Post(url, "application/octet-stream", bytes.NewBuffer(b))
+	conn, err := c.pool.Conn(addr)
 	if err != nil {
 		return 0, err
 	}
-	defer resp.Body.Close()
 
-	// read the response
-	if resp.StatusCode == http.StatusTemporaryRedirect {
-		return 0, errRedirect{host: resp.Header.Get("Location")}
-	} else if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("meta service returned %s", resp.Status)
+	if err := writeFrame(conn, b); err != nil {
+		c.pool.Discard(conn)
+		return 0, err
 	}
 
-	res := &internal.Response{}
-
-	b, err = ioutil.ReadAll(resp.Body)
+	b, err = readFrame(conn)
 	if err != nil {
+		c.pool.Discard(conn)
 		return 0, err
 	}
+	c.pool.Release(addr, conn)
 
+	res := &internal.Response{}
 	if err := proto.Unmarshal(b, res); err != nil {
 		return 0, err
 	}
+
 	es := res.GetError()
-	if es != "" {
+	// A server that isn't the leader replies with "not leader: <addr>" so
+	// the client can redirect the request to the actual leader instead of
+	// retrying against the same, non-leader server.
+	if strings.HasPrefix(es, notLeaderErrorPrefix) {
+		return 0, errRedirect{host: strings.TrimPrefix(es, notLeaderErrorPrefix)}
+	} else if es != "" {
 		return 0, errCommand{msg: es}
 	}
 
@@ -1391,28 +1834,10 @@ func (c *Client) waitForIndex(idx uint64) {
 	}
 }
 
-func (c *Client) pollForUpdates() {
-	for {
-		data := c.retryUntilSnapshot(c.index())
-		if data == nil {
-			// this will only be nil if the client has been closed,
-			// so we can exit out
-			return
-		}
-
-		// update the data and notify of the change
-		c.mu.Lock()
-		idx := c.cacheData.Data.Index
-		c.cacheData = data
-		c.updateAuthCache()
-		if idx < data.Data.Index {
-			close(c.changed)
-			c.changed = make(chan struct{})
-		}
-		c.mu.Unlock()
-	}
-}
-
+// getSnapshot fetches a single Data snapshot from server via a long-polled
+// HTTP request. It backs retryUntilSnapshot, which pollForUpdates (see
+// watch.go) falls back to when a streaming watch connection can't be
+// established, e.g. against an older meta server.
 func (c *Client) getSnapshot(server string, index uint64) (*Data, error) {
 	resp, err := c.get(server + fmt.Sprintf("?index=%d", index))
 	if err != nil {
@@ -1424,12 +1849,8 @@ func (c *Client) getSnapshot(server string, index uint64) (*Data, error) {
 		return nil, fmt.Errorf("meta server returned non-200: %s", resp.Status)
 	}
 
-	b, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
 	data := &Data{}
-	if err := data.UnmarshalBinary(b); err != nil {
+	if err := data.ReadSnapshotFrom(resp.Body); err != nil {
 		return nil, err
 	}
 
@@ -1437,48 +1858,53 @@ func (c *Client) getSnapshot(server string, index uint64) (*Data, error) {
 }
 
 func (c *Client) retryUntilSnapshot(idx uint64) *Data {
-	currentServer := 0
 	for {
 		if c.closed() {
 			return nil
 		}
-		metaServers := c.MetaServers()
-		if currentServer >= len(metaServers) {
-			currentServer = 0
+
+		preferred := c.healthTracker.preferred()
+		if len(preferred) == 0 {
+			preferred = c.MetaServers()
 		}
-		server := metaServers[currentServer]
 
-		data, err := c.getSnapshot(server, idx)
+		for _, server := range preferred {
+			data, err := c.getSnapshot(server, idx)
+			if err == nil {
+				c.healthTracker.promote(server)
+				return data
+			}
 
-		if err == nil {
-			return data
+			c.logger.Printf("failure getting snapshot from %s: %s", server, err.Error())
+			c.healthTracker.demote(server, err)
 		}
 
-		c.logger.Printf("failure getting snapshot from %s: %s", server, err.Error())
 		time.Sleep(errSleep)
-
-		currentServer++
 	}
 }
 
 func (c *Client) updateAuthCache() {
-	// copy cached user info for still-present users
-	newCache := make(map[string]authUser, len(c.authCache))
-
+	// Drop any cached entry whose hash no longer matches the persisted
+	// user hash; a changed hash means the cached entry was built from a
+	// credential that's no longer valid.
+	usersByName := make(map[string]string, len(c.cacheData.Users))
 	for _, userInfo := range c.cacheData.Users {
-		c.mu.RLock()
-		cached, ok := c.authCache[userInfo.Name]
-		c.mu.RUnlock()
-		if ok {
-			if cached.bhash == userInfo.Hash {
-				c.mu.Lock()
-				newCache[userInfo.Name] = cached
-				c.mu.Unlock()
-			}
-		}
+		usersByName[userInfo.Name] = userInfo.Hash
 	}
 
-	c.authCache = newCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, username := range c.authCache.usernames() {
+		hash, ok := usersByName[username]
+		if !ok {
+			c.authCache.delete(username)
+			continue
+		}
+		if au, ok := c.authCache.get(username); ok && au.bhash != hash {
+			c.authCache.delete(username)
+		}
+	}
 }
 
 func (c *Client) updateMetaServers() error {
@@ -1583,6 +2009,33 @@ func (c *Client) MetaServers() []string {
 	return c.metaServers
 }
 
+// writeFrame writes b to w as an 8-byte big-endian length prefix followed
+// by b itself.
+func writeFrame(w io.Writer, b []byte) error {
+	var sz [commandLenSize]byte
+	binary.BigEndian.PutUint64(sz[:], uint64(len(b)))
+	if _, err := w.Write(sz[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// readFrame reads an 8-byte big-endian length prefix from r followed by
+// that many bytes, as written by writeFrame.
+func readFrame(r io.Reader) ([]byte, error) {
+	var sz [commandLenSize]byte
+	if _, err := io.ReadFull(r, sz[:]); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, binary.BigEndian.Uint64(sz[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
 type errRedirect struct {
 	host string
 }
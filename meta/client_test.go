@@ -0,0 +1,56 @@
+package meta
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestClient_defaultRetentionPolicyInfo_ReplicaN(t *testing.T) {
+	tests := []struct {
+		nodes        int
+		wantReplicaN int
+	}{
+		{nodes: 1, wantReplicaN: 1},
+		{nodes: 2, wantReplicaN: 2},
+		{nodes: 3, wantReplicaN: 3},
+		{nodes: 5, wantReplicaN: 3},
+	}
+
+	for _, tt := range tests {
+		c := NewClient(&MetaConfig{})
+		data := &Data{}
+		for i := 0; i < tt.nodes; i++ {
+			host := fmt.Sprintf("host%d", i)
+			if err := data.CreateDataNode(host, host+":8088"); err != nil {
+				t.Fatalf("%d nodes: CreateDataNode: %s", tt.nodes, err)
+			}
+		}
+		c.cacheData = data
+
+		rpi := c.defaultRetentionPolicyInfo("autogen", 0)
+		if rpi == nil {
+			t.Fatalf("%d nodes: defaultRetentionPolicyInfo returned nil", tt.nodes)
+		}
+		if rpi.ReplicaN != tt.wantReplicaN {
+			t.Errorf("%d nodes: ReplicaN = %d, want %d", tt.nodes, rpi.ReplicaN, tt.wantReplicaN)
+		}
+	}
+}
+
+func TestClient_defaultRetentionPolicyInfo_SetDefaultReplication(t *testing.T) {
+	c := NewClient(&MetaConfig{})
+	data := &Data{}
+	for i := 0; i < 5; i++ {
+		host := fmt.Sprintf("host%d", i)
+		if err := data.CreateDataNode(host, host+":8088"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.cacheData = data
+	c.SetDefaultReplication(2)
+
+	rpi := c.defaultRetentionPolicyInfo("autogen", 0)
+	if rpi.ReplicaN != 2 {
+		t.Errorf("ReplicaN = %d, want 2", rpi.ReplicaN)
+	}
+}
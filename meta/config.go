@@ -0,0 +1,97 @@
+package meta
+
+import (
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+const (
+	// DefaultAuthCacheSize is the default number of entries kept in the
+	// client's bounded authentication cache.
+	DefaultAuthCacheSize = 1024
+
+	// DefaultShardGroupPrecreateAdvancePeriod is how far ahead of time
+	// the precreator extends shard group coverage by default.
+	DefaultShardGroupPrecreateAdvancePeriod = 30 * time.Minute
+
+	// DefaultShardGroupPrecreateCheckInterval is the default interval
+	// between precreator runs.
+	DefaultShardGroupPrecreateCheckInterval = 10 * time.Minute
+)
+
+// MetaConfig represents the configuration for the meta service.
+type MetaConfig struct {
+	// Dir is the directory where the client persists its local state,
+	// such as the known set of meta servers.
+	Dir string `toml:"dir"`
+
+	// BindAddress is the TCP address this node's meta service listens on.
+	BindAddress string `toml:"bind-address"`
+
+	// RetentionAutoCreate controls whether a default retention policy is
+	// automatically created for new databases.
+	RetentionAutoCreate bool `toml:"retention-autocreate"`
+
+	// AuthCacheSize bounds the number of entries kept in the client's
+	// authentication cache. Once full, the least recently used entry is
+	// evicted to make room for new ones. A value <= 0 falls back to
+	// DefaultAuthCacheSize.
+	AuthCacheSize int `toml:"auth-cache-size"`
+
+	// MaxAutoCreatedReplicaN caps the replication factor chosen for a
+	// database's auto-created retention policy, regardless of how many
+	// data nodes are in the cluster. A value <= 0 falls back to
+	// maxAutoCreatedRetentionPolicyReplicaN.
+	MaxAutoCreatedReplicaN int `toml:"max-autocreated-retention-replicaN"`
+
+	// ConsistencyMode is either "eventual" or "linearizable"; the parsed
+	// value is reported by Client.ConsistencyMode. ShardOwner,
+	// ShardsByTimeRange and Data always read the client's cached Data as
+	// it is, whatever the mode; linearizable reads go through
+	// LinearizableRead or the *Linearizable variants.
+	ConsistencyMode string `toml:"consistency-mode"`
+
+	// ShardGroupPrecreateAdvancePeriod is how far into the future the
+	// precreator extends shard group coverage on each run. A value <= 0
+	// falls back to DefaultShardGroupPrecreateAdvancePeriod.
+	ShardGroupPrecreateAdvancePeriod time.Duration `toml:"shard-group-precreate-advance-period"`
+
+	// ShardGroupPrecreateCheckInterval is how often the precreator
+	// checks whether new shard groups need creating. A value <= 0 falls
+	// back to DefaultShardGroupPrecreateCheckInterval.
+	ShardGroupPrecreateCheckInterval time.Duration `toml:"shard-group-precreate-check-interval"`
+
+	// MetricsSink receives the embedded Store's per-command Apply
+	// timers/counters/gauges (see storeFSM.Apply), plus Snapshot/Restore
+	// timers. Nil, the default, discards them; operators wire in a
+	// Prometheus or statsd sink from github.com/armon/go-metrics here.
+	// Not a TOML field: a sink is a live object, not config data.
+	MetricsSink metrics.MetricSink `toml:"-"`
+
+	// AuditLogPath, if set, is a file storeFSM.Apply appends one JSON
+	// line to for every signed command it applies (see AuditEntry).
+	// Ignored unless TrustedKeys is also set.
+	AuditLogPath string `toml:"audit-log-path"`
+
+	// TrustedKeys is the set of public keys storeFSM.Apply accepts
+	// signed commands from. Empty, the default, disables signature
+	// verification entirely: every raft log entry is treated as a
+	// plain, unsigned internal.Command exactly as before signing
+	// existed. Not a TOML field: keys are loaded from wherever the
+	// operator's key management lives, not inlined into this config.
+	TrustedKeys []TrustedKey `toml:"-"`
+
+	// SigningKey, if set, is the identity Client.submitCommand signs
+	// outgoing commands with before proposing them. Nil, the default,
+	// sends plain unsigned commands. Not a TOML field, for the same
+	// reason as TrustedKeys.
+	SigningKey *SigningIdentity `toml:"-"`
+}
+
+// NewMetaConfig returns a MetaConfig with defaults applied.
+func NewMetaConfig() *MetaConfig {
+	return &MetaConfig{
+		AuthCacheSize: DefaultAuthCacheSize,
+	}
+}
@@ -0,0 +1,163 @@
+package meta
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/influxdata/influxdb/influxql"
+	"github.com/influxdata/influxdb/services/meta"
+)
+
+// readIndexPath is the HTTP endpoint a meta server exposes to answer a
+// ReadIndex request: it returns the raft index committed as of the
+// moment the leader received the request.
+const readIndexPath = "/readindex"
+
+// ConsistencyMode selects how far a read is allowed to lag the raft
+// leader. Most callers are fine with ConsistencyEventual, which is
+// whatever pollForUpdates/the streaming watch (see watch.go) has most
+// recently delivered; callers that must not miss a write that's racing
+// with their read (e.g. a query scheduled right after CreateShardGroup)
+// should use ConsistencyLinearizable instead.
+type ConsistencyMode int
+
+const (
+	// ConsistencyEventual reads the client's local cacheData as-is.
+	ConsistencyEventual ConsistencyMode = iota
+
+	// ConsistencyLinearizable blocks, via LinearizableRead, until
+	// cacheData has caught up to the index the leader had committed at
+	// the moment of the read.
+	ConsistencyLinearizable
+)
+
+// String returns the toml/config spelling of m.
+func (m ConsistencyMode) String() string {
+	switch m {
+	case ConsistencyLinearizable:
+		return "linearizable"
+	default:
+		return "eventual"
+	}
+}
+
+// ParseConsistencyMode parses the MetaConfig.ConsistencyMode setting.
+// An empty string is treated as ConsistencyEventual.
+func ParseConsistencyMode(s string) (ConsistencyMode, error) {
+	switch s {
+	case "", "eventual":
+		return ConsistencyEventual, nil
+	case "linearizable":
+		return ConsistencyLinearizable, nil
+	default:
+		return ConsistencyEventual, fmt.Errorf("unknown consistency mode %q", s)
+	}
+}
+
+// readIndexResponse is the JSON body returned by a meta server's
+// /readindex endpoint.
+type readIndexResponse struct {
+	Index uint64 `json:"index"`
+}
+
+// LinearizableRead implements etcd's ReadIndex pattern: it asks the
+// current leader for the raft index it had committed at the moment of
+// the request, then blocks until the client's local cacheData has caught
+// up to it. A caller that follows LinearizableRead with ShardOwner or
+// ShardsByTimeRange is guaranteed to see every write the leader had
+// acknowledged before the read began, at the cost of a network
+// round-trip it wouldn't otherwise pay.
+func (c *Client) LinearizableRead(ctx context.Context) error {
+	addr := c.LeaderAddr()
+	if addr == "" {
+		servers := c.healthTracker.preferred()
+		if len(servers) == 0 {
+			servers = c.MetaServers()
+		}
+		if len(servers) == 0 {
+			return ErrServiceUnavailable
+		}
+		addr = servers[0]
+	}
+
+	idx, err := c.readIndex(ctx, addr)
+	if err != nil {
+		return err
+	}
+
+	return c.waitForIndexContext(ctx, idx)
+}
+
+// readIndex issues the actual /readindex request against addr.
+func (c *Client) readIndex(ctx context.Context, addr string) (uint64, error) {
+	req, err := http.NewRequest("GET", "http://"+addr+readIndexPath, nil)
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		c.healthTracker.demote(addr, err)
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("meta server returned non-200 for read index: %s", resp.Status)
+	}
+
+	var r readIndexResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return 0, err
+	}
+
+	c.healthTracker.promote(addr)
+	return r.Index, nil
+}
+
+// waitForIndexContext is waitForIndex with an early exit when ctx is
+// canceled, so a linearizable read can't block forever.
+func (c *Client) waitForIndexContext(ctx context.Context, idx uint64) error {
+	for {
+		c.mu.RLock()
+		if c.cacheData.Data.Index >= idx {
+			c.mu.RUnlock()
+			return nil
+		}
+		ch := c.changed
+		c.mu.RUnlock()
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// ShardOwnerLinearizable is ShardOwner preceded by a LinearizableRead, for
+// callers that must not miss a shard group created just before the call,
+// e.g. a write racing with CreateShardGroup.
+func (c *Client) ShardOwnerLinearizable(ctx context.Context, shardID uint64) (database, policy string, sgi *meta.ShardGroupInfo, err error) {
+	if err := c.LinearizableRead(ctx); err != nil {
+		return "", "", nil, err
+	}
+
+	database, policy, sgi = c.ShardOwner(shardID)
+	return database, policy, sgi, nil
+}
+
+// ShardsByTimeRangeLinearizable is ShardsByTimeRange preceded by a
+// LinearizableRead, for callers that must not miss a shard group created
+// just before the call.
+func (c *Client) ShardsByTimeRangeLinearizable(ctx context.Context, sources influxql.Sources, tmin, tmax time.Time) ([]meta.ShardInfo, error) {
+	if err := c.LinearizableRead(ctx); err != nil {
+		return nil, err
+	}
+
+	return c.ShardsByTimeRange(sources, tmin, tmax)
+}
@@ -35,6 +35,23 @@ type Data struct {
 	MetaNodes NodeInfos
 	DataNodes NodeInfos
 	MaxNodeID uint64
+
+	// Roles holds every RBAC role configured cluster-wide. See
+	// CreateRole/AddRoleUsers/SetRolePrivilege and UserPrivilege, which
+	// unions a user's direct grants with whatever their roles grant.
+	Roles []RoleInfo
+
+	// RecentNonces is a bounded, most-recent-last window of SignedCommand
+	// nonces storeFSM.Apply has already accepted, used to reject a
+	// replayed command; see seenNonce/rememberNonce in signing.go.
+	RecentNonces [][]byte
+
+	// RebalanceHook, if set, is called after a data node is added to or
+	// removed from the cluster via CreateDataNode/DeleteDataNode. It's
+	// the rebalancer's hook for noticing that placement may now be
+	// skewed; see PlanRebalance. Not copied across Clone, so it should
+	// be set once on the FSM's long-lived *Data, not a snapshot.
+	RebalanceHook func(nodeID uint64, added bool)
 }
 
 // Clone returns a copy of data with a new version.
@@ -60,6 +77,23 @@ func (data *Data) Clone() *Data {
 		}
 	}
 
+	// Copy roles.
+	if data.Roles != nil {
+		other.Roles = make([]RoleInfo, len(data.Roles))
+		for i := range data.Roles {
+			other.Roles[i] = data.Roles[i].clone()
+		}
+	}
+
+	// Copy the nonce window so appending to other's never aliases data's.
+	if data.RecentNonces != nil {
+		other.RecentNonces = append([][]byte(nil), data.RecentNonces...)
+	}
+
+	// RebalanceHook is a hook for the FSM's long-lived *Data, not
+	// something a point-in-time snapshot should carry.
+	other.RebalanceHook = nil
+
 	return &other
 }
 
@@ -76,11 +110,60 @@ type NodeInfo struct {
 	Host               string
 	TCPHost            string
 	PendingShardOwners uint64arr
+
+	// Zone is the node's failure domain (e.g. rack or availability
+	// zone). RendezvousPlacer avoids putting two replicas of the same
+	// shard in the same Zone when there are enough distinct zones to
+	// honor that. Empty means the node isn't in any particular domain.
+	Zone string
 }
 
 // clone returns a deep copy of ni.
 func (ni NodeInfo) clone() NodeInfo { return ni }
 
+// MarshalBinary encodes ni into a binary format, round-tripping through
+// the internal.NodeInfo protobuf.
+func (ni NodeInfo) MarshalBinary() ([]byte, error) {
+	return proto.Marshal(ni.marshal())
+}
+
+// UnmarshalBinary decodes ni from a binary format produced by
+// NodeInfo.MarshalBinary.
+func (ni *NodeInfo) UnmarshalBinary(buf []byte) error {
+	var pb internal.NodeInfo
+	if err := proto.Unmarshal(buf, &pb); err != nil {
+		return err
+	}
+	ni.unmarshal(&pb)
+	return nil
+}
+
+// MarshalBinary encodes nis into a binary format.
+func (nis NodeInfos) MarshalBinary() ([]byte, error) {
+	pb := &internal.NodeInfos{
+		Items: make([]*internal.NodeInfo, len(nis)),
+	}
+	for i := range nis {
+		pb.Items[i] = nis[i].marshal()
+	}
+	return proto.Marshal(pb)
+}
+
+// UnmarshalBinary decodes nis from a binary format produced by
+// NodeInfos.MarshalBinary.
+func (nis *NodeInfos) UnmarshalBinary(buf []byte) error {
+	var pb internal.NodeInfos
+	if err := proto.Unmarshal(buf, &pb); err != nil {
+		return err
+	}
+	a := make(NodeInfos, len(pb.GetItems()))
+	for i, item := range pb.GetItems() {
+		a[i].unmarshal(item)
+	}
+	*nis = a
+	return nil
+}
+
 // marshal serializes to a protobuf representation.
 func (ni NodeInfo) marshal() *internal.NodeInfo {
 	pb := &internal.NodeInfo{}
@@ -91,6 +174,7 @@ func (ni NodeInfo) marshal() *internal.NodeInfo {
 	for _, pso := range ni.PendingShardOwners {
 		pb.PendingShardOwners = append(pb.PendingShardOwners, *proto.Uint64(pso))
 	}
+	pb.Zone = proto.String(ni.Zone)
 	return pb
 }
 
@@ -100,6 +184,7 @@ func (ni *NodeInfo) unmarshal(pb *internal.NodeInfo) {
 	ni.Host = pb.GetHost()
 	ni.TCPHost = pb.GetTCPHost()
 	ni.PendingShardOwners = pb.GetPendingShardOwners()
+	ni.Zone = pb.GetZone()
 }
 
 func (data *Data) MetaNode(id uint64) *NodeInfo {
@@ -298,6 +383,10 @@ func (data *Data) CreateDataNode(host, tcpHost string) error {
 	})
 	sort.Sort(NodeInfos(data.DataNodes))
 
+	if data.RebalanceHook != nil {
+		data.RebalanceHook(existingID, true)
+	}
+
 	return nil
 }
 
@@ -331,9 +420,73 @@ func (data *Data) DeleteDataNode(id uint64) error {
 		return ErrNodeNotFound
 	}
 	data.DataNodes = nodes
+	data.reassignOrphanedShards(id)
+
+	if data.RebalanceHook != nil {
+		data.RebalanceHook(id, false)
+	}
 
 	return nil
 }
+
+// reassignOrphanedShards replaces removedNodeID as an owner of every
+// shard that still lists it, picking a replacement with the same
+// RendezvousPlacer used by CreateShardGroup so placement stays
+// deterministic and reproducible across meta nodes.
+func (data *Data) reassignOrphanedShards(removedNodeID uint64) {
+	if len(data.DataNodes) == 0 {
+		return
+	}
+
+	placer := RendezvousPlacer{Salt: data.Data.ClusterID}
+	for _, dbi := range data.Data.Databases {
+		for _, rpi := range dbi.RetentionPolicies {
+			for gi := range rpi.ShardGroups {
+				sg := &rpi.ShardGroups[gi]
+				if sg.Deleted() {
+					continue
+				}
+				for si := range sg.Shards {
+					sh := &sg.Shards[si]
+
+					orphaned := false
+					remaining := make([]meta.ShardOwner, 0, len(sh.Owners))
+					for _, o := range sh.Owners {
+						if o.NodeID == removedNodeID {
+							orphaned = true
+							continue
+						}
+						remaining = append(remaining, o)
+					}
+					if !orphaned {
+						continue
+					}
+
+					candidates := make([]NodeInfo, 0, len(data.DataNodes))
+					for _, n := range data.DataNodes {
+						alreadyOwns := false
+						for _, o := range remaining {
+							if o.NodeID == n.ID {
+								alreadyOwns = true
+								break
+							}
+						}
+						if !alreadyOwns {
+							candidates = append(candidates, n)
+						}
+					}
+
+					if len(candidates) > 0 {
+						replacement := placer.PlaceShard(candidates, sh.ID, 1)
+						remaining = append(remaining, replacement...)
+					}
+					sh.Owners = remaining
+				}
+			}
+		}
+	}
+}
+
 func (data *Data) MarshalBinary() ([]byte, error) {
 	return proto.Marshal(data.marshal())
 }
@@ -356,6 +509,11 @@ func (data *Data) marshal() *internal.ClusterData {
 
 	pb.Users = make([]*internal.UserInfo, len(data.Users))
 
+	pb.Roles = make([]*internal.RoleInfo, len(data.Roles))
+	for i := range data.Roles {
+		pb.Roles[i] = data.Roles[i].marshal()
+	}
+
 	return pb
 }
 
@@ -378,10 +536,51 @@ func (data *Data) unmarshal(pb *internal.ClusterData) {
 	for i, meta := range pb.GetMetaNodes() {
 		data.MetaNodes[i].unmarshal(meta)
 	}
+
+	data.Roles = make([]RoleInfo, len(pb.GetRoles()))
+	for i, r := range pb.GetRoles() {
+		data.Roles[i].unmarshal(r)
+	}
+
+	data.DataNodes = make([]NodeInfo, len(pb.GetDataNodes()))
+	for i, n := range pb.GetDataNodes() {
+		data.DataNodes[i].unmarshal(n)
+	}
 }
 
 // CreateShardGroup creates a shard group on a database and policy for a given timestamp.
 func (data *Data) CreateShardGroup(database, policy string, timestamp time.Time) error {
+	return data.createShardGroup(database, policy, timestamp, RendezvousPlacer{Salt: data.Data.ClusterID})
+}
+
+// CreateBalancedShardGroup is CreateShardGroup's counterpart for rebalance
+// and decommission work: instead of rendezvous hashing, it assigns owners
+// to whichever data nodes currently hold the fewest shards cluster-wide,
+// so a group created to take over from a truncated one doesn't just pile
+// back onto the same nodes the move was meant to relieve.
+func (data *Data) CreateBalancedShardGroup(database, policy string, timestamp time.Time) error {
+	load := make(map[uint64]int, len(data.DataNodes))
+	for _, dbi := range data.Data.Databases {
+		for _, rpi := range dbi.RetentionPolicies {
+			for _, sg := range rpi.ShardGroups {
+				if sg.Deleted() {
+					continue
+				}
+				for _, sh := range sg.Shards {
+					for _, o := range sh.Owners {
+						load[o.NodeID]++
+					}
+				}
+			}
+		}
+	}
+	return data.createShardGroup(database, policy, timestamp, &LeastLoadedPlacer{Load: load})
+}
+
+// createShardGroup is the shared implementation behind CreateShardGroup
+// and CreateBalancedShardGroup; they differ only in how owners are
+// chosen for each shard.
+func (data *Data) createShardGroup(database, policy string, timestamp time.Time, placer ShardPlacer) error {
 	// Ensure there are nodes in the metadata.
 	if len(data.DataNodes) == 0 {
 		return nil
@@ -422,16 +621,9 @@ func (data *Data) CreateShardGroup(database, policy string, timestamp time.Time)
 	sgi.EndTime = sgi.StartTime.Add(rpi.ShardGroupDuration).UTC()
 
 	sgi.Shards = data.generatedShards(shardN)
-	// Assign data nodes to shards via round robin.
-	// Start from a repeatably "random" place in the node list.
-	nodeIndex := int(data.Data.Index % uint64(len(data.DataNodes)))
 	for i := range sgi.Shards {
 		si := &sgi.Shards[i]
-		for j := 0; j < replicaN; j++ {
-			nodeID := data.DataNodes[nodeIndex%len(data.DataNodes)].ID
-			si.Owners = append(si.Owners, meta.ShardOwner{NodeID: nodeID})
-			nodeIndex++
-		}
+		si.Owners = placer.PlaceShard(data.DataNodes, si.ID, replicaN)
 	}
 
 	// Retention policy has a new shard group, so update the policy. Shard
@@ -443,6 +635,73 @@ func (data *Data) CreateShardGroup(database, policy string, timestamp time.Time)
 	return nil
 }
 
+// precreateTarget identifies a single shard group PrecreateShardGroups
+// (or the raft-driven precreator loop in store.go) is about to create.
+type precreateTarget struct {
+	Database  string
+	Policy    string
+	Timestamp time.Time
+}
+
+// planPrecreateShardGroups finds every (database, policy, timestamp)
+// PrecreateShardGroups would create between from and to without creating
+// any of them, so a caller that needs to commit through a different path
+// than direct mutation (the raft-backed precreator loop in store.go,
+// which must apply one CreateShardGroupCommand per target instead) can
+// work from the same plan.
+func (data *Data) planPrecreateShardGroups(from, to time.Time) []precreateTarget {
+	var targets []precreateTarget
+	for _, dbi := range data.Data.Databases {
+		for _, rpi := range dbi.RetentionPolicies {
+			if rpi.ShardGroupDuration <= 0 {
+				continue
+			}
+
+			var newest *meta.ShardGroupInfo
+			for i := range rpi.ShardGroups {
+				sg := &rpi.ShardGroups[i]
+				if sg.Deleted() {
+					continue
+				}
+				if newest == nil || sg.EndTime.After(newest.EndTime) {
+					newest = sg
+				}
+			}
+			if newest == nil {
+				continue
+			}
+
+			// A policy whose newest group ended before the window we're
+			// even advancing into hasn't taken a write recently; don't
+			// keep spinning up perpetual empty groups for it.
+			if newest.EndTime.Before(from.Add(-rpi.ShardGroupDuration)) {
+				continue
+			}
+
+			for next := newest.EndTime; next.Before(to); next = next.Add(rpi.ShardGroupDuration) {
+				targets = append(targets, precreateTarget{Database: dbi.Name, Policy: rpi.Name, Timestamp: next})
+			}
+		}
+	}
+	return targets
+}
+
+// PrecreateShardGroups walks every retention policy and, through the
+// same code path as CreateShardGroup (so replica assignment is handled
+// identically), allocates whatever contiguous shard groups are needed to
+// extend each policy's coverage from its newest existing group up to to.
+// Precreating removes raft-consensus latency from the write path for
+// writes that land exactly on a shard-group boundary, since the group is
+// already there by the time they arrive.
+func (data *Data) PrecreateShardGroups(from, to time.Time) error {
+	for _, t := range data.planPrecreateShardGroups(from, to) {
+		if err := data.CreateShardGroup(t.Database, t.Policy, t.Timestamp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (data *Data) gcd() {
 
 }
@@ -458,26 +717,88 @@ func (data *Data) generatedShards(shardN int) []meta.ShardInfo {
 	return shards
 }
 
-func (data *Data) TruncateShardsGrops(sg *meta.ShardGroupInfo) error {
+// TruncateShardsGrops pulls sg's EndTime in to t, provided t actually
+// falls inside the group, so no write after t can land in a group that's
+// being moved or decommissioned. It's used when a data node is
+// decommissioned or a rebalance needs to stop new shards from landing on
+// a group mid-move; CreateShardGroup will open a fresh group to take over
+// once this one's EndTime passes.
+func (data *Data) TruncateShardsGrops(sg *meta.ShardGroupInfo, t time.Time) error {
+	if t.Before(sg.StartTime) || !t.Before(sg.EndTime) {
+		return nil
+	}
+	sg.EndTime = t
+	data.Data.Index++
 	return nil
 }
 
-func (data *Data) AddPendingShardOwner(id uint64) {
-	for _, node := range data.MetaNodes {
-		node.PendingShardOwners = append(node.PendingShardOwners, id)
+// AddPendingShardOwner records nodeID as a prospective (not yet live) new
+// owner of the shard identified by shardID, so a background copier knows
+// to start streaming it there. It's idempotent, the same as
+// AddShardOwner.
+func (data *Data) AddPendingShardOwner(shardID, nodeID uint64) error {
+	node := data.DataNode(nodeID)
+	if node == nil {
+		return ErrNodeNotFound
 	}
+	if _, err := data.ShardLocation(shardID); err != nil {
+		return err
+	}
+
+	for _, id := range node.PendingShardOwners {
+		if id == shardID {
+			return nil
+		}
+	}
+	node.PendingShardOwners = append(node.PendingShardOwners, shardID)
+	return nil
 }
 
-func (data *Data) RemovePendingShardOwner(id uint64) {
-	for _, node := range data.MetaNodes {
-		newPso := uint64arr{}
-		for _, pso := range node.PendingShardOwners {
-			if id != pso {
-				newPso = append(newPso, pso)
-			}
+// RemovePendingShardOwner drops shardID from nodeID's list of prospective
+// owners, whether the move was committed or abandoned. It's idempotent.
+func (data *Data) RemovePendingShardOwner(shardID, nodeID uint64) error {
+	node := data.DataNode(nodeID)
+	if node == nil {
+		return ErrNodeNotFound
+	}
+
+	kept := node.PendingShardOwners[:0]
+	for _, id := range node.PendingShardOwners {
+		if id != shardID {
+			kept = append(kept, id)
 		}
-		node.PendingShardOwners = newPso
 	}
+	node.PendingShardOwners = kept
+	return nil
+}
+
+// CommitPendingShardOwner promotes nodeID from a pending, in-copy owner
+// of shardID to a live one: it's added to the shard's real Owners list
+// and dropped from nodeID's PendingShardOwners. The caller (a background
+// copier reporting its TSM/WAL stream has landed) is responsible for
+// calling this only once replication has actually completed; committing
+// early just means reads may briefly miss data on that node.
+func (data *Data) CommitPendingShardOwner(shardID, nodeID uint64) error {
+	node := data.DataNode(nodeID)
+	if node == nil {
+		return ErrNodeNotFound
+	}
+
+	pending := false
+	for _, id := range node.PendingShardOwners {
+		if id == shardID {
+			pending = true
+			break
+		}
+	}
+	if !pending {
+		return ErrShardNotFound
+	}
+
+	if err := data.AddShardOwner(shardID, nodeID); err != nil {
+		return err
+	}
+	return data.RemovePendingShardOwner(shardID, nodeID)
 }
 
 type ShardOwners []meta.ShardOwner
@@ -494,58 +815,85 @@ func (so ShardOwners) Swap(i, j int) {
 	so[i], so[j] = so[j], so[i]
 }
 
-//ShardLocation return NodeInfos which is the o of the Shard
+// ShardLocation returns a pointer to the shard identified by shardID,
+// into data's own backing arrays rather than a range-loop copy, so
+// callers like UpdateShard can mutate it in place and have the change
+// actually stick.
 func (data *Data) ShardLocation(shardID uint64) (*meta.ShardInfo, error) {
 	for _, dbi := range data.Data.Databases {
 		for _, rpi := range dbi.RetentionPolicies {
-			for _, sg := range rpi.ShardGroups {
-				for _, s := range sg.Shards {
-					//found such shards, return shards
-					if s.ID == shardID {
-						return &s, nil
+			for gi := range rpi.ShardGroups {
+				sg := &rpi.ShardGroups[gi]
+				for si := range sg.Shards {
+					if sg.Shards[si].ID == shardID {
+						return &sg.Shards[si], nil
 					}
 				}
 			}
 		}
 	}
-	//does not find any shards assoicated with this shardID, just reutn nil, error
-	return nil, fmt.Errorf("failed to find shards assoicated with %d", shardID)
+	return nil, ErrShardNotFound
 }
 
-// UpdateShard will update ShardOwner of a Shard according to ShardID
+// UpdateShard replaces the owners of the shard identified by shardID
+// with newOwners in place and bumps data.Data.Index, the same way every
+// other mutation through *Data signals that the cluster's metadata has
+// moved forward.
 func (data *Data) UpdateShard(shardID uint64, newOwners []meta.ShardOwner) error {
-	return fmt.Errorf("Failed to find Shard assoicated with shard ID %d", shardID)
+	si, err := data.ShardLocation(shardID)
+	if err != nil {
+		return err
+	}
+
+	si.Owners = newOwners
+	data.Data.Index++
+	return nil
 }
 
-// AddShardOwner will update a shards labelled by shardID in this node if such shards ownby this newly adding node
+// AddShardOwner adds nodeID as an owner of the shard identified by
+// shardID. It's idempotent: adding a node that's already an owner is a
+// no-op rather than a duplicate owner entry.
 func (data *Data) AddShardOwner(shardID, nodeID uint64) error {
 	si, err := data.ShardLocation(shardID)
-	if err == nil {
-		if !si.OwnedBy(nodeID) {
-			if nodeID > data.MaxNodeID {
-				return nil
-			}
-			o := ShardOwners{}
-			o = append(o, meta.ShardOwner{NodeID: nodeID})
-			sort.Sort(o)
-			return data.UpdateShard(shardID, o)
-		}
+	if err != nil {
+		return err
+	}
+	if data.DataNode(nodeID) == nil {
+		return ErrNodeNotFound
 	}
-	return err
+	if si.OwnedBy(nodeID) {
+		return nil
+	}
+
+	o := append(ShardOwners{}, si.Owners...)
+	o = append(o, meta.ShardOwner{NodeID: nodeID})
+	sort.Sort(o)
+	return data.UpdateShard(shardID, o)
 }
 
-// RemoveShardOwner will remove all shards in this node if such shard owned by this node
+// RemoveShardOwner removes nodeID as an owner of the shard identified by
+// shardID. It's idempotent: removing a node that isn't currently an
+// owner is a no-op rather than an error.
 func (data *Data) RemoveShardOwner(shardID, nodeID uint64) error {
 	si, err := data.ShardLocation(shardID)
 	if err != nil {
-		if si.OwnedBy(nodeID) {
-			o, _ := data.PruneShard(si, nodeID)
-			data.UpdateShard(shardID, o)
-		}
+		return err
 	}
-	return err
+	if !si.OwnedBy(nodeID) {
+		return nil
+	}
+
+	o, err := data.PruneShard(si, nodeID)
+	if err != nil {
+		return err
+	}
+	return data.UpdateShard(shardID, o)
 }
 
+// PruneShard returns si's owners with nodeID removed. si must point into
+// data's own backing array (see ShardLocation); PruneShard doesn't look
+// the shard up itself so AddShardOwner/RemoveShardOwner callers that
+// already hold si from ShardLocation don't pay for a second lookup.
 func (data *Data) PruneShard(si *meta.ShardInfo, nodeID uint64) ([]meta.ShardOwner, error) {
 	found := -1
 	for i, o := range si.Owners {
@@ -554,41 +902,18 @@ func (data *Data) PruneShard(si *meta.ShardInfo, nodeID uint64) ([]meta.ShardOwn
 			break
 		}
 	}
+	if found == -1 {
+		return nil, ErrNodeNotFound
+	}
 
-	if found != -1 {
-		copy(si.Owners[found:], si.Owners[found+1:])
-		// si.Owners[len(si.Owners)-1] = nil
-		// si.Owners = si.Owners[:len(si.Owners)-1]
-		return si.Owners, nil
-	}
-	return nil, fmt.Errorf("failed to find shard owner %d", nodeID)
-}
-
-func (data *Data) ImportData(buf []byte) error {
-	// other := Data{}
-	// if err := other.UnmarshalBinary(buf); err != nil {
-	// 	return err
-	// }
-
-	// // Restrict(other)
-	// for dbidx, db := range data.Data.Databases {
-	// 	dbn := other.Database(db.Name)
-	// 	if dbn == nil {
-	// 		if err = other.CreateDatabase(db.Name); err != nil {
-	// 			return err
-	// 		}
-	// 	}
-	// 	for _, rpi := range db.RetentionPolicies {
-	// 		other.CreateRetentionPolicy(dbn.Name, dbn.RetentionPolicy(rpi.Name))
-	// 		data.generatedShards(rpi.ShardGroups)
-	// 	}
-
-	// }
-	//sort
-	//call gcd
-	return nil
+	owners := make([]meta.ShardOwner, 0, len(si.Owners)-1)
+	owners = append(owners, si.Owners[:found]...)
+	owners = append(owners, si.Owners[found+1:]...)
+	return owners, nil
 }
 
+// ImportData is implemented in import.go.
+
 type uint64arr []uint64
 
 func (u uint64arr) Len() int {
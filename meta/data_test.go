@@ -0,0 +1,209 @@
+package meta
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/services/meta"
+)
+
+// newImportSource builds a standalone *Data, as if it came from another
+// cluster, with one database/retention policy/shard group/shard ready to
+// round-trip through MarshalBinary for ImportData.
+func newImportSource(t *testing.T, rp meta.RetentionPolicyInfo, sg meta.ShardGroupInfo) []byte {
+	t.Helper()
+
+	rp.ShardGroups = []meta.ShardGroupInfo{sg}
+	src := &meta.Data{
+		Databases: []meta.DatabaseInfo{
+			{Name: "db0", RetentionPolicies: []meta.RetentionPolicyInfo{rp}},
+		},
+	}
+
+	buf, err := src.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %s", err)
+	}
+	return buf
+}
+
+func newImportDest(t *testing.T, nodes int) *Data {
+	t.Helper()
+
+	dst := &Data{Data: &meta.Data{}}
+	for i := 0; i < nodes; i++ {
+		host := fmt.Sprintf("host%d", i)
+		if err := dst.CreateDataNode(host, host+":8088"); err != nil {
+			t.Fatalf("CreateDataNode: %s", err)
+		}
+	}
+	return dst
+}
+
+func TestData_ImportData_RemapsIDsAndAvoidsCollisions(t *testing.T) {
+	dst := newImportDest(t, 2)
+	// Pre-existing shard group using the same IDs the import is about to
+	// bring in, so a naive import would collide if it kept source IDs.
+	if err := dst.Data.CreateDatabase("db0"); err != nil {
+		t.Fatal(err)
+	}
+	rpi := meta.NewRetentionPolicyInfo("autogen")
+	if err := dst.Data.CreateRetentionPolicy("db0", rpi, true); err != nil {
+		t.Fatal(err)
+	}
+	dst.Data.MaxShardGroupID = 1
+	dst.Data.MaxShardID = 1
+	existing := meta.ShardGroupInfo{
+		ID:        1,
+		StartTime: time.Unix(0, 0).UTC(),
+		EndTime:   time.Unix(0, 0).UTC().Add(time.Hour),
+		Shards:    []meta.ShardInfo{{ID: 1}},
+	}
+	rpi, err := dst.Data.RetentionPolicy("db0", "autogen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpi.ShardGroups = append(rpi.ShardGroups, existing)
+
+	buf := newImportSource(t,
+		meta.RetentionPolicyInfo{Name: "autogen", ReplicaN: 1, Duration: 0, ShardGroupDuration: time.Hour},
+		meta.ShardGroupInfo{
+			ID:        1,
+			StartTime: time.Unix(0, 0).UTC(),
+			EndTime:   time.Unix(0, 0).UTC().Add(time.Hour),
+			Shards:    []meta.ShardInfo{{ID: 1, Owners: []meta.ShardOwner{{NodeID: 1}}}},
+		},
+	)
+
+	idMap, err := dst.ImportData(buf, MergeSkip, false)
+	if err != nil {
+		t.Fatalf("ImportData: %s", err)
+	}
+
+	if got := idMap[1]; got == 0 || got == 1 {
+		t.Errorf("imported shard group ID = %d, want a fresh ID distinct from the colliding source ID 1", got)
+	}
+
+	rpi, err = dst.Data.RetentionPolicy("db0", "autogen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rpi.ShardGroups) != 2 {
+		t.Fatalf("ShardGroups = %d, want 2 (pre-existing + imported)", len(rpi.ShardGroups))
+	}
+	seen := make(map[uint64]bool)
+	for _, sg := range rpi.ShardGroups {
+		if seen[sg.ID] {
+			t.Errorf("duplicate shard group ID %d after import", sg.ID)
+		}
+		seen[sg.ID] = true
+	}
+}
+
+func TestData_ImportData_RetentionPolicyMergePolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		mp         MergePolicy
+		wantErr    bool
+		wantReplN  int
+		wantDurHrs int
+	}{
+		{name: "skip leaves existing policy alone", mp: MergeSkip, wantReplN: 1, wantDurHrs: 1},
+		{name: "overwrite takes the incoming policy", mp: MergeOverwrite, wantReplN: 2, wantDurHrs: 2},
+		{name: "error aborts on conflict", mp: MergeError, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := newImportDest(t, 2)
+			if err := dst.Data.CreateDatabase("db0"); err != nil {
+				t.Fatal(err)
+			}
+			rpi := meta.NewRetentionPolicyInfo("autogen")
+			rpi.ReplicaN = 1
+			rpi.Duration = time.Hour
+			if err := dst.Data.CreateRetentionPolicy("db0", rpi, true); err != nil {
+				t.Fatal(err)
+			}
+
+			buf := newImportSource(t,
+				meta.RetentionPolicyInfo{Name: "autogen", ReplicaN: 2, Duration: 2 * time.Hour, ShardGroupDuration: time.Hour},
+				meta.ShardGroupInfo{
+					ID:        1,
+					StartTime: time.Unix(0, 0).UTC(),
+					EndTime:   time.Unix(0, 0).UTC().Add(time.Hour),
+					Shards:    []meta.ShardInfo{{ID: 1}},
+				},
+			)
+
+			_, err := dst.ImportData(buf, tt.mp, false)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("ImportData: expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ImportData: %s", err)
+			}
+
+			got, err := dst.Data.RetentionPolicy("db0", "autogen")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ReplicaN != tt.wantReplN {
+				t.Errorf("ReplicaN = %d, want %d", got.ReplicaN, tt.wantReplN)
+			}
+			if got.Duration != time.Duration(tt.wantDurHrs)*time.Hour {
+				t.Errorf("Duration = %s, want %dh", got.Duration, tt.wantDurHrs)
+			}
+		})
+	}
+}
+
+func TestData_ImportData_PartialOverlapKeepsBothShardGroups(t *testing.T) {
+	dst := newImportDest(t, 2)
+	if err := dst.Data.CreateDatabase("db0"); err != nil {
+		t.Fatal(err)
+	}
+	rpi := meta.NewRetentionPolicyInfo("autogen")
+	rpi.ShardGroupDuration = time.Hour
+	if err := dst.Data.CreateRetentionPolicy("db0", rpi, true); err != nil {
+		t.Fatal(err)
+	}
+	rpi, err := dst.Data.RetentionPolicy("db0", "autogen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An existing shard group covering [0h, 1h30m), which overlaps the
+	// [1h, 2h) group the import is about to bring in.
+	rpi.ShardGroups = append(rpi.ShardGroups, meta.ShardGroupInfo{
+		ID:        100,
+		StartTime: time.Unix(0, 0).UTC(),
+		EndTime:   time.Unix(0, 0).UTC().Add(90 * time.Minute),
+		Shards:    []meta.ShardInfo{{ID: 200}},
+	})
+
+	buf := newImportSource(t,
+		meta.RetentionPolicyInfo{Name: "autogen", ReplicaN: 1, ShardGroupDuration: time.Hour},
+		meta.ShardGroupInfo{
+			ID:        1,
+			StartTime: time.Unix(0, 0).UTC().Add(time.Hour),
+			EndTime:   time.Unix(0, 0).UTC().Add(2 * time.Hour),
+			Shards:    []meta.ShardInfo{{ID: 1}},
+		},
+	)
+
+	if _, err := dst.ImportData(buf, MergeSkip, false); err != nil {
+		t.Fatalf("ImportData: %s", err)
+	}
+
+	rpi, err = dst.Data.RetentionPolicy("db0", "autogen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rpi.ShardGroups) != 2 {
+		t.Fatalf("ShardGroups = %d, want 2 (import doesn't merge overlapping time ranges, it keeps both)", len(rpi.ShardGroups))
+	}
+}
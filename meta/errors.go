@@ -0,0 +1,81 @@
+package meta
+
+import "errors"
+
+var (
+	// ErrNodeExists is returned when creating a node that already exists.
+	ErrNodeExists = errors.New("node already exists")
+
+	// ErrNodeNotFound is returned when mutating or querying a node that
+	// doesn't exist.
+	ErrNodeNotFound = errors.New("node not found")
+
+	// ErrUserExists is returned when creating a user that already exists
+	// with different attributes.
+	ErrUserExists = errors.New("user already exists")
+
+	// ErrUserNotFound is returned when mutating or querying a user that
+	// doesn't exist.
+	ErrUserNotFound = errors.New("user not found")
+
+	// ErrAuthenticate is returned when authentication fails.
+	ErrAuthenticate = errors.New("authentication failed")
+
+	// ErrRetentionPolicyExists is returned when creating a retention
+	// policy that already exists.
+	ErrRetentionPolicyExists = errors.New("retention policy already exists")
+
+	// ErrRetentionPolicyConflict is returned when creating a retention
+	// policy that conflicts with an existing one of the same name.
+	ErrRetentionPolicyConflict = errors.New("retention policy conflicts with an existing one")
+
+	// ErrRetentionPolicyDurationTooLow is returned when creating or
+	// updating a retention policy with a duration lower than
+	// MinRetentionPolicyDuration.
+	ErrRetentionPolicyDurationTooLow = errors.New("retention policy duration too low")
+
+	// ErrReplicationFactorTooHigh is returned when creating or updating a
+	// retention policy with a replication factor greater than the number
+	// of live data nodes in the cluster.
+	ErrReplicationFactorTooHigh = errors.New("replication factor too high for live data node count")
+
+	// ErrShardNotFound is returned when mutating or querying a shard
+	// that doesn't exist.
+	ErrShardNotFound = errors.New("shard not found")
+
+	// ErrRoleExists is returned when creating a role that already
+	// exists, or renaming one to a name already in use.
+	ErrRoleExists = errors.New("role already exists")
+
+	// ErrRoleNotFound is returned when mutating or querying a role that
+	// doesn't exist.
+	ErrRoleNotFound = errors.New("role not found")
+
+	// ErrImportClusterIDMismatch is returned when Data.Import is given a
+	// payload exported from a different cluster and opts.Force isn't
+	// set.
+	ErrImportClusterIDMismatch = errors.New("import: payload was exported from a different cluster; retry with force to proceed anyway")
+
+	// ErrSignatureInvalid is returned when a SignedCommand's signature
+	// doesn't verify against any of the store's trusted keys.
+	ErrSignatureInvalid = errors.New("command signature is invalid or signed by an untrusted key")
+
+	// ErrNonceReplayed is returned when a SignedCommand's nonce has
+	// already been applied, indicating a replayed log entry.
+	ErrNonceReplayed = errors.New("command nonce has already been applied")
+)
+
+const (
+	// maxAutoCreatedRetentionPolicyReplicaN is the maximum replication
+	// factor applied to a database's auto-created retention policy,
+	// regardless of how many data nodes are in the cluster.
+	maxAutoCreatedRetentionPolicyReplicaN = 3
+
+	// autoCreateRetentionPolicyName is the name given to a database's
+	// auto-created retention policy.
+	autoCreateRetentionPolicyName = DefaultRetentionPolicyName
+
+	// autoCreateRetentionPolicyPeriod is the duration given to a
+	// database's auto-created retention policy.
+	autoCreateRetentionPolicyPeriod = DefaultRetentionPolicyDuration
+)
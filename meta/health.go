@@ -0,0 +1,334 @@
+package meta
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// statusPath is the HTTP endpoint every meta server exposes for
+	// health and leadership probing.
+	statusPath = "/status"
+
+	// healthCheckInterval is how often the background tracker pings
+	// every known meta server.
+	healthCheckInterval = 5 * time.Second
+
+	// healthCheckTimeout bounds a single /status request.
+	healthCheckTimeout = 2 * time.Second
+
+	// minNodeBackoff and maxNodeBackoff bound the exponential backoff
+	// applied to a node after a failed command or health check, so a
+	// node that's down doesn't get retried on every single command.
+	minNodeBackoff = 500 * time.Millisecond
+	maxNodeBackoff = 30 * time.Second
+)
+
+// metaServerStatus is the JSON body returned by a meta server's
+// /status endpoint.
+type metaServerStatus struct {
+	Leader string `json:"leader"`
+	Term   uint64 `json:"term"`
+}
+
+// MetaNodeHealth is the tracker's current view of one meta server,
+// exposed via Client.MetaServerHealth for observability.
+type MetaNodeHealth struct {
+	Addr       string
+	Healthy    bool
+	Leader     bool
+	Latency    time.Duration
+	Term       uint64
+	LeaderHint string
+	LastError  string
+	LastCheck  time.Time
+}
+
+// nodeHealth is the tracker's mutable bookkeeping for a single meta
+// server.
+type nodeHealth struct {
+	addr       string
+	healthy    bool
+	leader     bool
+	latency    time.Duration
+	term       uint64
+	leaderHint string
+	lastError  string
+	lastCheck  time.Time
+
+	failures int
+	backoff  time.Duration
+	nextTry  time.Time
+}
+
+// metaServerTracker maintains a sorted preference list of meta servers so
+// retryUntilExec/retryUntilSnapshot can start from the cached leader
+// instead of round-robining through every server on every call. A node is
+// demoted (and backed off exponentially) the moment it returns a
+// connection error or redirects elsewhere, and the redirect target is
+// promoted immediately instead of waiting for the next health check.
+type metaServerTracker struct {
+	mu    sync.RWMutex
+	nodes map[string]*nodeHealth
+
+	httpClient *http.Client
+	closing    chan struct{}
+}
+
+// newMetaServerTracker returns a tracker with no known servers yet; call
+// start to begin background health checks once the client knows its
+// metaServers.
+func newMetaServerTracker() *metaServerTracker {
+	return &metaServerTracker{
+		nodes:      make(map[string]*nodeHealth),
+		httpClient: &http.Client{Timeout: healthCheckTimeout},
+		closing:    make(chan struct{}),
+	}
+}
+
+// start begins periodically pinging every server in addrs until stop is
+// called. It's safe to call again after the set of meta servers changes;
+// nodes no longer present are dropped.
+func (t *metaServerTracker) start(addrs []string) {
+	t.mu.Lock()
+	seen := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		seen[addr] = true
+		if _, ok := t.nodes[addr]; !ok {
+			t.nodes[addr] = &nodeHealth{addr: addr, healthy: true}
+		}
+	}
+	for addr := range t.nodes {
+		if !seen[addr] {
+			delete(t.nodes, addr)
+		}
+	}
+	t.mu.Unlock()
+
+	go t.run()
+}
+
+// stop halts the background health-check goroutine.
+func (t *metaServerTracker) stop() {
+	select {
+	case <-t.closing:
+	default:
+		close(t.closing)
+	}
+}
+
+func (t *metaServerTracker) run() {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+
+	t.checkAll()
+	for {
+		select {
+		case <-t.closing:
+			return
+		case <-ticker.C:
+			t.checkAll()
+		}
+	}
+}
+
+func (t *metaServerTracker) checkAll() {
+	t.mu.RLock()
+	addrs := make([]string, 0, len(t.nodes))
+	for addr := range t.nodes {
+		addrs = append(addrs, addr)
+	}
+	t.mu.RUnlock()
+
+	for _, addr := range addrs {
+		t.check(addr)
+	}
+}
+
+func (t *metaServerTracker) check(addr string) {
+	start := time.Now()
+	resp, err := t.httpClient.Get("http://" + addr + statusPath)
+	if err != nil {
+		t.demote(addr, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var status metaServerStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.demote(addr, err)
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := t.node(addr)
+	n.healthy = true
+	n.latency = time.Since(start)
+	n.term = status.Term
+	n.leaderHint = status.Leader
+	n.lastError = ""
+	n.lastCheck = time.Now()
+	n.failures = 0
+	n.backoff = 0
+	n.leader = status.Leader == "" || status.Leader == addr
+}
+
+// node returns t.nodes[addr], creating it if this is the first time
+// we've heard of it (e.g. a redirect to a server outside metaServers).
+// Callers must hold t.mu.
+func (t *metaServerTracker) node(addr string) *nodeHealth {
+	n, ok := t.nodes[addr]
+	if !ok {
+		n = &nodeHealth{addr: addr}
+		t.nodes[addr] = n
+	}
+	return n
+}
+
+// demote marks addr unhealthy and applies exponential backoff before it's
+// preferred again.
+func (t *metaServerTracker) demote(addr string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := t.node(addr)
+	n.healthy = false
+	n.leader = false
+	n.lastError = err.Error()
+	n.lastCheck = time.Now()
+	n.failures++
+
+	backoff := n.backoff * 2
+	if backoff < minNodeBackoff {
+		backoff = minNodeBackoff
+	}
+	if backoff > maxNodeBackoff {
+		backoff = maxNodeBackoff
+	}
+	n.backoff = backoff
+	n.nextTry = time.Now().Add(backoff)
+}
+
+// promote marks addr as the current leader, clearing any backoff so it's
+// preferred immediately. Used both after a successful command and when a
+// server redirects us to the real leader.
+func (t *metaServerTracker) promote(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for a, n := range t.nodes {
+		n.leader = a == addr
+	}
+
+	n := t.node(addr)
+	n.healthy = true
+	n.failures = 0
+	n.backoff = 0
+	n.lastError = ""
+}
+
+// leaderAddr returns the cached leader address, or "" if none is known
+// yet.
+func (t *metaServerTracker) leaderAddr() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for addr, n := range t.nodes {
+		if n.leader {
+			return addr
+		}
+	}
+	return ""
+}
+
+// preferred returns every known meta server address, ordered: the cached
+// leader first, then other healthy nodes by latency, then every
+// unhealthy node, whether or not its backoff has expired, ordered by
+// when it comes off backoff, soonest first.
+func (t *metaServerTracker) preferred() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	nodes := make([]*nodeHealth, 0, len(t.nodes))
+	for _, n := range t.nodes {
+		nodes = append(nodes, n)
+	}
+
+	sort.SliceStable(nodes, func(i, j int) bool {
+		a, b := nodes[i], nodes[j]
+		if a.leader != b.leader {
+			return a.leader
+		}
+		if a.healthy != b.healthy {
+			return a.healthy
+		}
+		if a.healthy {
+			return a.latency < b.latency
+		}
+		// Both unhealthy: prefer whichever comes off backoff sooner.
+		return a.nextTry.Before(b.nextTry)
+	})
+
+	addrs := make([]string, len(nodes))
+	for i, n := range nodes {
+		addrs[i] = n.addr
+	}
+	return addrs
+}
+
+// snapshot returns the tracker's current view of every known meta
+// server, for Client.MetaServerHealth.
+func (t *metaServerTracker) snapshot() []MetaNodeHealth {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	health := make([]MetaNodeHealth, 0, len(t.nodes))
+	for _, n := range t.nodes {
+		health = append(health, MetaNodeHealth{
+			Addr:       n.addr,
+			Healthy:    n.healthy,
+			Leader:     n.leader,
+			Latency:    n.latency,
+			Term:       n.term,
+			LeaderHint: n.leaderHint,
+			LastError:  n.lastError,
+			LastCheck:  n.lastCheck,
+		})
+	}
+
+	sort.Slice(health, func(i, j int) bool { return health[i].Addr < health[j].Addr })
+	return health
+}
+
+// MetaServerHealth returns the tracker's current view of every known meta
+// server, for observability (e.g. a /debug/vars style endpoint).
+func (c *Client) MetaServerHealth() []MetaNodeHealth {
+	c.mu.RLock()
+	tracker := c.healthTracker
+	c.mu.RUnlock()
+
+	if tracker == nil {
+		return nil
+	}
+	return tracker.snapshot()
+}
+
+// LeaderAddr returns the meta client's best current guess at the raft
+// leader's address, or "" if none is known yet. Callers like the query
+// coordinator can use this to pin a sequence of follow-up requests to the
+// same node instead of letting each one pick independently.
+func (c *Client) LeaderAddr() string {
+	c.mu.RLock()
+	tracker := c.healthTracker
+	c.mu.RUnlock()
+
+	if tracker == nil {
+		return ""
+	}
+	return tracker.leaderAddr()
+}
@@ -0,0 +1,354 @@
+package meta
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/influxdata/influxdb/services/meta"
+)
+
+// importMagic and importSchemaVersion identify the header
+// wrapImportPayload prepends to an exported blob, so Data.Import can
+// reject a payload produced by a future, incompatible format before
+// touching the receiver.
+var importMagic = [4]byte{'I', 'M', 'P', 'T'}
+
+const importSchemaVersion = 1
+
+// importHeaderLen is the size of the header wrapImportPayload writes:
+// importMagic, a version byte, and an 8-byte big-endian ClusterID.
+const importHeaderLen = len(importMagic) + 1 + 8
+
+// ImportOptions controls how Data.Import, Client.ImportMeta, and
+// applyImportDataCommand apply an exported payload.
+type ImportOptions struct {
+	// Merge, true, merges the payload into the receiver via ImportData,
+	// the way an operator combines another cluster's databases into
+	// this one. False, the payload is a full cluster snapshot (see
+	// Data.ExportSnapshot) and replaces the receiver's Data outright:
+	// the restore path for rebuilding a broken meta cluster.
+	Merge bool
+
+	// MergePolicy controls retention policy conflicts when Merge is
+	// true; see MergePolicy. Ignored otherwise.
+	MergePolicy MergePolicy
+
+	// DryRun, true, computes and returns the ImportResult without
+	// mutating the receiver.
+	DryRun bool
+
+	// Force skips the ClusterID check below, and, when Merge is true,
+	// the user/subscription collision check ImportData performs.
+	Force bool
+}
+
+// ImportResult summarizes what Data.Import did, or, for a dry run, would
+// have done.
+type ImportResult struct {
+	// Replaced is true when the receiver's Data was (or would be)
+	// replaced outright rather than merged.
+	Replaced bool
+
+	// DatabasesAdded lists databases the merge added that didn't
+	// already exist on the receiver. Unset when Replaced is true.
+	DatabasesAdded []string
+
+	// ShardGroupIDMap maps every imported shard/shard group ID to the
+	// new ID it was assigned to avoid colliding with the receiver's
+	// own, as returned by ImportData. Unset when Replaced is true.
+	ShardGroupIDMap map[uint64]uint64
+
+	// DryRun is true if this result was computed without mutating the
+	// receiver.
+	DryRun bool
+}
+
+// wrapImportPayload prepends importMagic, importSchemaVersion, and
+// clusterID to blob, the framing Data.Import validates before parsing
+// the blob beneath it.
+func wrapImportPayload(clusterID uint64, blob []byte) []byte {
+	buf := make([]byte, 0, importHeaderLen+len(blob))
+	buf = append(buf, importMagic[:]...)
+	buf = append(buf, importSchemaVersion)
+
+	var id [8]byte
+	binary.BigEndian.PutUint64(id[:], clusterID)
+	buf = append(buf, id[:]...)
+
+	return append(buf, blob...)
+}
+
+// unwrapImportPayload reverses wrapImportPayload, validating the magic
+// and schema version before returning the ClusterID and blob it wraps.
+func unwrapImportPayload(buf []byte) (clusterID uint64, blob []byte, err error) {
+	if len(buf) < importHeaderLen || string(buf[:len(importMagic)]) != string(importMagic[:]) {
+		return 0, nil, fmt.Errorf("import: missing or unrecognized header")
+	}
+
+	version := buf[len(importMagic)]
+	if version != importSchemaVersion {
+		return 0, nil, fmt.Errorf("import: unsupported schema version %d", version)
+	}
+
+	idOffset := len(importMagic) + 1
+	clusterID = binary.BigEndian.Uint64(buf[idOffset : idOffset+8])
+	return clusterID, buf[idOffset+8:], nil
+}
+
+// ExportSnapshot wraps data.MarshalBinary (the full cluster Data) with
+// the header Data.Import expects for a Merge=false restore: the payload
+// for rebuilding a broken meta cluster from a backup of this one.
+func (data *Data) ExportSnapshot() ([]byte, error) {
+	b, err := data.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return wrapImportPayload(data.Data.ClusterID, b), nil
+}
+
+// ExportForMerge wraps srcData (as produced by (*meta.Data).MarshalBinary
+// on another cluster) with the same header, for a Merge=true import via
+// Data.ImportData.
+func ExportForMerge(srcClusterID uint64, srcData []byte) []byte {
+	return wrapImportPayload(srcClusterID, srcData)
+}
+
+// Import applies an exported payload (see ExportSnapshot/ExportForMerge)
+// to data according to opts. Unless opts.Force is set, it refuses to
+// proceed if the payload's ClusterID differs from data's own, since a
+// payload exported from an unrelated cluster is almost never what an
+// operator restoring or merging meant to apply.
+func (data *Data) Import(buf []byte, opts ImportOptions) (*ImportResult, error) {
+	clusterID, payload, err := unwrapImportPayload(buf)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.Force && data.Data.ClusterID != 0 && clusterID != data.Data.ClusterID {
+		return nil, ErrImportClusterIDMismatch
+	}
+
+	if !opts.Merge {
+		var restored Data
+		if err := restored.UnmarshalBinary(payload); err != nil {
+			return nil, err
+		}
+		if !opts.DryRun {
+			*data = restored
+		}
+		return &ImportResult{Replaced: true, DryRun: opts.DryRun}, nil
+	}
+
+	target := data
+	if opts.DryRun {
+		target = data.Clone()
+	}
+
+	before := make(map[string]bool, len(target.Data.Databases))
+	for _, db := range target.Data.Databases {
+		before[db.Name] = true
+	}
+
+	idMap, err := target.ImportData(payload, opts.MergePolicy, opts.Force)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ImportResult{ShardGroupIDMap: idMap, DryRun: opts.DryRun}
+	for _, db := range target.Data.Databases {
+		if !before[db.Name] {
+			result.DatabasesAdded = append(result.DatabasesAdded, db.Name)
+		}
+	}
+	return result, nil
+}
+
+// MergePolicy controls how Data.ImportData reconciles a retention policy
+// that already exists under the same database/name on both sides of an
+// import.
+type MergePolicy int
+
+const (
+	// MergeSkip leaves the receiver's retention policy untouched when it
+	// conflicts with the incoming one.
+	MergeSkip MergePolicy = iota
+
+	// MergeOverwrite replaces the receiver's Duration, ReplicaN and
+	// ShardGroupDuration with the incoming retention policy's values.
+	MergeOverwrite
+
+	// MergeError aborts the import with an error the moment a retention
+	// policy conflicts. Changes Import already made to the receiver for
+	// earlier databases and retention policies stay in place.
+	MergeError
+)
+
+// String returns mp's config/flag spelling.
+func (mp MergePolicy) String() string {
+	switch mp {
+	case MergeSkip:
+		return "skip"
+	case MergeOverwrite:
+		return "overwrite"
+	case MergeError:
+		return "error"
+	default:
+		return fmt.Sprintf("MergePolicy(%d)", int(mp))
+	}
+}
+
+// ParseMergePolicy parses the config/flag spelling of a MergePolicy. An
+// empty string defaults to MergeSkip.
+func ParseMergePolicy(s string) (MergePolicy, error) {
+	switch s {
+	case "", "skip":
+		return MergeSkip, nil
+	case "overwrite":
+		return MergeOverwrite, nil
+	case "error":
+		return MergeError, nil
+	default:
+		return MergeSkip, fmt.Errorf("unknown merge policy %q", s)
+	}
+}
+
+// ImportData merges the Data encoded in buf, as produced by
+// MarshalBinary/WriteSnapshotTo on another cluster, into data. This is
+// the restore side of an influxd-ctl-style backup taken on one cluster
+// and replayed onto another.
+//
+// Databases missing from data are created outright. A retention policy
+// present on both sides is left alone, overwritten or treated as a fatal
+// conflict according to mp; a retention policy only present in the
+// import is always created as-is. Every shard group and shard is
+// assigned a fresh ID from data's own MaxShardGroupID/MaxShardID
+// sequence, since the importing cluster's ID space has nothing to do
+// with the source cluster's, and its shards are placed on data's own
+// DataNodes with the same RendezvousPlacer CreateShardGroup uses rather
+// than kept on the source cluster's node IDs. The returned map takes
+// every old shard and shard group ID to its new one, so the caller can
+// tell the data nodes restoring the backup which TSM directories to
+// rewrite.
+//
+// Unless force is true, ImportData refuses to proceed if the import
+// would add a user or subscription that collides by name with one data
+// already has, since silently overwriting either is rarely what an
+// operator restoring a backup wants.
+func (data *Data) ImportData(buf []byte, mp MergePolicy, force bool) (map[uint64]uint64, error) {
+	other := &meta.Data{}
+	if err := other.UnmarshalBinary(buf); err != nil {
+		return nil, err
+	}
+
+	if !force {
+		if err := data.checkImportCollisions(other); err != nil {
+			return nil, err
+		}
+	}
+
+	idMap := make(map[uint64]uint64)
+	placer := RendezvousPlacer{Salt: data.Data.ClusterID}
+
+	for _, odb := range other.Databases {
+		if data.Data.Database(odb.Name) == nil {
+			if err := data.Data.CreateDatabase(odb.Name); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, orp := range odb.RetentionPolicies {
+			rpi, err := data.Data.RetentionPolicy(odb.Name, orp.Name)
+			if err != nil {
+				return nil, err
+			}
+
+			if rpi == nil {
+				np := orp
+				np.ShardGroups = nil
+				if err := data.Data.CreateRetentionPolicy(odb.Name, &np, false); err != nil {
+					return nil, err
+				}
+				if rpi, err = data.Data.RetentionPolicy(odb.Name, orp.Name); err != nil {
+					return nil, err
+				}
+			} else if rpi.Duration != orp.Duration || rpi.ReplicaN != orp.ReplicaN || rpi.ShardGroupDuration != orp.ShardGroupDuration {
+				switch mp {
+				case MergeOverwrite:
+					rpu := meta.RetentionPolicyUpdate{
+						Duration:           &orp.Duration,
+						ReplicaN:           &orp.ReplicaN,
+						ShardGroupDuration: &orp.ShardGroupDuration,
+					}
+					if err := data.Data.UpdateRetentionPolicy(odb.Name, orp.Name, &rpu, false); err != nil {
+						return nil, err
+					}
+					if rpi, err = data.Data.RetentionPolicy(odb.Name, orp.Name); err != nil {
+						return nil, err
+					}
+				case MergeError:
+					return nil, fmt.Errorf("import: retention policy %q.%q conflicts with an existing policy and MergePolicy is error", odb.Name, orp.Name)
+				case MergeSkip:
+					// Leave rpi as the receiver already had it.
+				}
+			}
+
+			for _, osg := range orp.ShardGroups {
+				sgi := osg
+				data.Data.MaxShardGroupID++
+				idMap[osg.ID] = data.Data.MaxShardGroupID
+				sgi.ID = data.Data.MaxShardGroupID
+
+				sgi.Shards = make([]meta.ShardInfo, len(osg.Shards))
+				for i, osh := range osg.Shards {
+					data.Data.MaxShardID++
+					idMap[osh.ID] = data.Data.MaxShardID
+
+					replicaN := len(osh.Owners)
+					if replicaN == 0 {
+						replicaN = 1
+					}
+					sgi.Shards[i] = meta.ShardInfo{
+						ID:     data.Data.MaxShardID,
+						Owners: placer.PlaceShard(data.DataNodes, data.Data.MaxShardID, replicaN),
+					}
+				}
+
+				rpi.ShardGroups = append(rpi.ShardGroups, sgi)
+			}
+			sort.Sort(meta.ShardGroupInfos(rpi.ShardGroups))
+		}
+	}
+
+	return idMap, nil
+}
+
+// checkImportCollisions returns an error naming the first user or
+// subscription other carries that would collide by name with one data
+// already has.
+func (data *Data) checkImportCollisions(other *meta.Data) error {
+	for _, ou := range other.Users {
+		for _, u := range data.Data.Users {
+			if u.Name == ou.Name {
+				return fmt.Errorf("import: user %q already exists; retry with force to proceed anyway", ou.Name)
+			}
+		}
+	}
+
+	for _, odb := range other.Databases {
+		for _, orp := range odb.RetentionPolicies {
+			for _, osub := range orp.Subscriptions {
+				existing, err := data.Subscriptions(odb.Name, orp.Name)
+				if err != nil {
+					continue
+				}
+				for _, sub := range existing {
+					if sub.Name == osub.Name {
+						return fmt.Errorf("import: subscription %q on %q.%q already exists; retry with force to proceed anyway", osub.Name, odb.Name, orp.Name)
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package meta
+
+import (
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/services/meta"
+)
+
+func TestData_Import_DryRunDoesNotMutate(t *testing.T) {
+	dst := newImportDest(t, 2)
+	dst.Data.ClusterID = 7
+
+	buf := newImportSource(t,
+		meta.RetentionPolicyInfo{Name: "autogen", ReplicaN: 1, ShardGroupDuration: time.Hour},
+		meta.ShardGroupInfo{
+			ID:        1,
+			StartTime: time.Unix(0, 0).UTC(),
+			EndTime:   time.Unix(0, 0).UTC().Add(time.Hour),
+			Shards:    []meta.ShardInfo{{ID: 1}},
+		},
+	)
+	payload := ExportForMerge(7, buf)
+
+	result, err := dst.Import(payload, ImportOptions{Merge: true, DryRun: true})
+	if err != nil {
+		t.Fatalf("Import (dry run): %s", err)
+	}
+	if !result.DryRun {
+		t.Fatal("expected DryRun to be true on the result")
+	}
+	if len(result.DatabasesAdded) != 1 || result.DatabasesAdded[0] != "db0" {
+		t.Fatalf("DatabasesAdded = %v, want [db0]", result.DatabasesAdded)
+	}
+	if len(result.ShardGroupIDMap) != 2 {
+		t.Fatalf("ShardGroupIDMap = %v, want 2 entries (shard group + shard)", result.ShardGroupIDMap)
+	}
+
+	// A dry run must leave the receiver untouched.
+	if dst.Data.Database("db0") != nil {
+		t.Fatal("dry run created db0 on the receiver")
+	}
+}
+
+func TestData_Import_MergeAppliesAndRemapsIDs(t *testing.T) {
+	dst := newImportDest(t, 2)
+	dst.Data.ClusterID = 7
+	dst.Data.MaxShardGroupID = 1
+	dst.Data.MaxShardID = 1
+
+	buf := newImportSource(t,
+		meta.RetentionPolicyInfo{Name: "autogen", ReplicaN: 1, ShardGroupDuration: time.Hour},
+		meta.ShardGroupInfo{
+			ID:        1,
+			StartTime: time.Unix(0, 0).UTC(),
+			EndTime:   time.Unix(0, 0).UTC().Add(time.Hour),
+			Shards:    []meta.ShardInfo{{ID: 1}},
+		},
+	)
+	payload := ExportForMerge(7, buf)
+
+	result, err := dst.Import(payload, ImportOptions{Merge: true})
+	if err != nil {
+		t.Fatalf("Import: %s", err)
+	}
+	if result.Replaced {
+		t.Fatal("expected a merge, not a replace")
+	}
+	if len(result.DatabasesAdded) != 1 || result.DatabasesAdded[0] != "db0" {
+		t.Fatalf("DatabasesAdded = %v, want [db0]", result.DatabasesAdded)
+	}
+
+	db0 := dst.Data.Database("db0")
+	if db0 == nil {
+		t.Fatal("expected db0 to have been created")
+	}
+	sg := db0.RetentionPolicies[0].ShardGroups[0]
+	if sg.ID == 1 || sg.Shards[0].ID == 1 {
+		t.Fatalf("imported shard group/shard kept colliding source IDs: %+v", sg)
+	}
+	if newID, ok := result.ShardGroupIDMap[1]; !ok || newID != sg.ID {
+		t.Fatalf("ShardGroupIDMap[1] = %d, want %d", newID, sg.ID)
+	}
+}
+
+func TestData_Import_ClusterIDMismatch(t *testing.T) {
+	dst := newImportDest(t, 1)
+	dst.Data.ClusterID = 7
+
+	payload := ExportForMerge(99, newImportSource(t,
+		meta.RetentionPolicyInfo{Name: "autogen", ReplicaN: 1},
+		meta.ShardGroupInfo{ID: 1},
+	))
+
+	if _, err := dst.Import(payload, ImportOptions{Merge: true}); err != ErrImportClusterIDMismatch {
+		t.Fatalf("got %v, want ErrImportClusterIDMismatch", err)
+	}
+
+	// Force bypasses the check.
+	if _, err := dst.Import(payload, ImportOptions{Merge: true, Force: true}); err != nil {
+		t.Fatalf("Import with force: %s", err)
+	}
+}
+
+func TestData_Import_ReplaceRestoresFullSnapshot(t *testing.T) {
+	src := &Data{Data: &meta.Data{ClusterID: 7}}
+	if err := src.Data.CreateDatabase("restored"); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.CreateDataNode("srchost", "srchost:8088"); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := src.ExportSnapshot()
+	if err != nil {
+		t.Fatalf("ExportSnapshot: %s", err)
+	}
+
+	dst := newImportDest(t, 1)
+	dst.Data.ClusterID = 7
+	if err := dst.Data.CreateDatabase("local-only"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := dst.Import(payload, ImportOptions{Merge: false})
+	if err != nil {
+		t.Fatalf("Import (replace): %s", err)
+	}
+	if !result.Replaced {
+		t.Fatal("expected Replaced to be true")
+	}
+
+	if dst.Data.Database("local-only") != nil {
+		t.Fatal("replace should have discarded the receiver's prior databases")
+	}
+	if dst.Data.Database("restored") == nil {
+		t.Fatal("expected the restored database to be present")
+	}
+	if len(dst.DataNodes) != 1 || dst.DataNodes[0].Host != "srchost" {
+		t.Fatalf("DataNodes = %v, want the snapshot's one node \"srchost\"", dst.DataNodes)
+	}
+}
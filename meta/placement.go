@@ -0,0 +1,168 @@
+package meta
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+
+	"github.com/influxdata/influxdb/services/meta"
+)
+
+// ShardPlacer chooses which data nodes own a shard. The default is
+// RendezvousPlacer; CreateShardGroup and DeleteDataNode's orphan
+// reassignment both go through it so placement decisions stay in one
+// place.
+type ShardPlacer interface {
+	// PlaceShard returns up to replicaN owners for shardID, chosen from
+	// candidates and ordered from most to least preferred.
+	PlaceShard(candidates []NodeInfo, shardID uint64, replicaN int) []meta.ShardOwner
+}
+
+// RendezvousPlacer implements highest-random-weight (rendezvous)
+// hashing: every candidate node is scored with hash64(nodeID, shardID,
+// Salt), and the top replicaN by score become the shard's owners.
+// Because a shard's scores depend only on that shard and the candidate
+// set, adding or removing a node only reshuffles the shards that scored
+// highest on it - O(shards/N) of them - instead of the wholesale
+// renumbering a round-robin index produces on every membership change.
+//
+// When enough candidates carry distinct, non-empty Zone labels to give
+// each replica its own zone, RendezvousPlacer skips candidates that
+// would put two replicas of the same shard in the same zone.
+type RendezvousPlacer struct {
+	// Salt seeds the hash so placement is reproducible across meta
+	// nodes applying the same command. Callers use the cluster's
+	// ClusterID, which is itself generated once and replicated like any
+	// other piece of cluster metadata.
+	Salt uint64
+}
+
+type scoredNode struct {
+	node  NodeInfo
+	score uint64
+}
+
+// PlaceShard implements ShardPlacer.
+func (p RendezvousPlacer) PlaceShard(candidates []NodeInfo, shardID uint64, replicaN int) []meta.ShardOwner {
+	if replicaN > len(candidates) {
+		replicaN = len(candidates)
+	}
+	if replicaN <= 0 {
+		return nil
+	}
+
+	scored := make([]scoredNode, len(candidates))
+	for i, n := range candidates {
+		scored[i] = scoredNode{node: n, score: hash64(n.ID, shardID, p.Salt)}
+	}
+	sort.Slice(scored, func(i, j int) bool {
+		if scored[i].score != scored[j].score {
+			return scored[i].score > scored[j].score
+		}
+		// Break ties deterministically so a score collision doesn't
+		// make PlaceShard non-reproducible.
+		return scored[i].node.ID < scored[j].node.ID
+	})
+
+	honorZones := enoughZones(candidates, replicaN)
+
+	owners := make([]meta.ShardOwner, 0, replicaN)
+	usedZones := make(map[string]bool, replicaN)
+	for _, sn := range scored {
+		if len(owners) == replicaN {
+			return owners
+		}
+		if honorZones && sn.node.Zone != "" && usedZones[sn.node.Zone] {
+			continue
+		}
+		owners = append(owners, meta.ShardOwner{NodeID: sn.node.ID})
+		if sn.node.Zone != "" {
+			usedZones[sn.node.Zone] = true
+		}
+	}
+
+	// Not enough distinct zones were available to fill every replica
+	// while honoring the constraint; fill the rest by score alone
+	// rather than under-replicating the shard.
+	have := make(map[uint64]bool, len(owners))
+	for _, o := range owners {
+		have[o.NodeID] = true
+	}
+	for _, sn := range scored {
+		if len(owners) == replicaN {
+			break
+		}
+		if have[sn.node.ID] {
+			continue
+		}
+		owners = append(owners, meta.ShardOwner{NodeID: sn.node.ID})
+	}
+
+	return owners
+}
+
+// LeastLoadedPlacer implements ShardPlacer by handing each shard's
+// replicas to whichever candidates currently carry the fewest shards,
+// per Load. Load is shared across every PlaceShard call on the same
+// LeastLoadedPlacer, and is updated in place as shards are placed, so
+// assigning a whole shard group never piles every shard from it onto the
+// same handful of nodes.
+type LeastLoadedPlacer struct {
+	Load map[uint64]int
+}
+
+// PlaceShard implements ShardPlacer.
+func (p *LeastLoadedPlacer) PlaceShard(candidates []NodeInfo, shardID uint64, replicaN int) []meta.ShardOwner {
+	if replicaN > len(candidates) {
+		replicaN = len(candidates)
+	}
+	if replicaN <= 0 {
+		return nil
+	}
+	if p.Load == nil {
+		p.Load = make(map[uint64]int, len(candidates))
+	}
+
+	sorted := append([]NodeInfo(nil), candidates...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if p.Load[sorted[i].ID] != p.Load[sorted[j].ID] {
+			return p.Load[sorted[i].ID] < p.Load[sorted[j].ID]
+		}
+		// Break ties deterministically so placement doesn't depend on
+		// candidates' incoming order.
+		return sorted[i].ID < sorted[j].ID
+	})
+
+	owners := make([]meta.ShardOwner, 0, replicaN)
+	for i := 0; i < replicaN; i++ {
+		owners = append(owners, meta.ShardOwner{NodeID: sorted[i].ID})
+		p.Load[sorted[i].ID]++
+	}
+	return owners
+}
+
+// enoughZones reports whether candidates span at least replicaN
+// distinct non-empty zones, i.e. whether honoring one-replica-per-zone
+// is even possible.
+func enoughZones(candidates []NodeInfo, replicaN int) bool {
+	zones := make(map[string]bool)
+	for _, n := range candidates {
+		if n.Zone != "" {
+			zones[n.Zone] = true
+		}
+	}
+	return len(zones) >= replicaN
+}
+
+// hash64 combines nodeID, shardID and salt into a single FNV-1a score.
+// Rendezvous hashing only needs a hash that's uniform and independent
+// per (node, shard) pair, not a cryptographic one.
+func hash64(nodeID, shardID, salt uint64) uint64 {
+	h := fnv.New64a()
+	var b [24]byte
+	binary.BigEndian.PutUint64(b[0:8], nodeID)
+	binary.BigEndian.PutUint64(b[8:16], shardID)
+	binary.BigEndian.PutUint64(b[16:24], salt)
+	h.Write(b[:])
+	return h.Sum64()
+}
@@ -0,0 +1,176 @@
+package meta
+
+import (
+	"github.com/influxdata/influxdb/services/meta"
+)
+
+// ShardMove describes moving a single shard's ownership from one data
+// node to another, as planned by Data.PlanRebalance.
+type ShardMove struct {
+	ShardID    uint64
+	FromNodeID uint64
+	ToNodeID   uint64
+}
+
+// RebalanceOptions tunes Data.PlanRebalance.
+type RebalanceOptions struct {
+	// MaxMoves caps the number of moves a single plan returns, so a
+	// badly skewed cluster is nudged back into balance over several
+	// passes instead of moving every shard at once. <= 0 means
+	// unlimited.
+	MaxMoves int
+
+	// DryRun, true, makes Client.ApplyRebalance a no-op: it never
+	// executes the plan's moves, so an operator can pass the same plan
+	// and opts straight through to inspect what would happen without a
+	// separate check of their own. PlanRebalance itself never mutates
+	// data regardless of DryRun.
+	DryRun bool
+}
+
+// shardPlacement is PlanRebalance's working view of one shard: which
+// nodes currently own it.
+type shardPlacement struct {
+	shardID uint64
+	owners  []meta.ShardOwner
+}
+
+// PlanRebalance scores the cluster's current shard placement by
+// shards-per-node variance and replica co-location (no two replicas of
+// the same shard ever land on the same node) and returns the minimal set
+// of moves needed to even it back out. Shards with a move already
+// recorded via AddPendingShardOwner are left alone, so replanning never
+// doubles up on an in-flight move.
+func (data *Data) PlanRebalance(opts RebalanceOptions) []ShardMove {
+	if len(data.DataNodes) < 2 {
+		return nil
+	}
+
+	load := make(map[uint64]int, len(data.DataNodes))
+	for _, n := range data.DataNodes {
+		load[n.ID] = 0
+	}
+
+	pending := make(map[uint64]bool)
+	for _, n := range data.DataNodes {
+		for _, id := range n.PendingShardOwners {
+			pending[id] = true
+		}
+	}
+
+	var shards []shardPlacement
+	for _, dbi := range data.Data.Databases {
+		for _, rpi := range dbi.RetentionPolicies {
+			for _, sg := range rpi.ShardGroups {
+				if sg.Deleted() {
+					continue
+				}
+				for _, sh := range sg.Shards {
+					shards = append(shards, shardPlacement{shardID: sh.ID, owners: sh.Owners})
+					for _, o := range sh.Owners {
+						load[o.NodeID]++
+					}
+				}
+			}
+		}
+	}
+
+	var moves []ShardMove
+	for _, sp := range shards {
+		if pending[sp.shardID] {
+			continue
+		}
+
+		// excluded tracks every node that already holds (or, earlier in
+		// this same owner loop, has just been planned to receive) a
+		// replica of this shard, so two owners of the same shard never
+		// get planned onto the same destination.
+		excluded := append([]meta.ShardOwner(nil), sp.owners...)
+
+		for _, owner := range sp.owners {
+			if opts.MaxMoves > 0 && len(moves) >= opts.MaxMoves {
+				return moves
+			}
+
+			target := data.leastLoadedNodeExcluding(load, excluded)
+			// A target only helps if it doesn't already hold a replica
+			// of this shard, and moving to it is actually worth a data
+			// copy: a one-shard swing isn't.
+			if target == 0 || target == owner.NodeID || load[owner.NodeID]-load[target] < 2 {
+				continue
+			}
+
+			moves = append(moves, ShardMove{ShardID: sp.shardID, FromNodeID: owner.NodeID, ToNodeID: target})
+			excluded = append(excluded, meta.ShardOwner{NodeID: target})
+			load[owner.NodeID]--
+			load[target]++
+		}
+	}
+
+	return moves
+}
+
+// leastLoadedNodeExcluding returns the data node with the fewest shards
+// that isn't already an owner in owners, so a move never co-locates two
+// replicas of the same shard. Returns 0 if every node already owns a
+// copy.
+func (data *Data) leastLoadedNodeExcluding(load map[uint64]int, owners []meta.ShardOwner) uint64 {
+	owned := make(map[uint64]bool, len(owners))
+	for _, o := range owners {
+		owned[o.NodeID] = true
+	}
+
+	var best uint64
+	bestLoad := -1
+	for _, n := range data.DataNodes {
+		if owned[n.ID] {
+			continue
+		}
+		if bestLoad == -1 || load[n.ID] < bestLoad {
+			best = n.ID
+			bestLoad = load[n.ID]
+		}
+	}
+	return best
+}
+
+// PlanRebalance is the client-facing entry point for Data.PlanRebalance,
+// exposed so operators (or an automated rebalancing loop) can request and
+// inspect a plan before committing to it with ApplyRebalance.
+func (c *Client) PlanRebalance(opts RebalanceOptions) []ShardMove {
+	return c.data().PlanRebalance(opts)
+}
+
+// ApplyRebalance executes plan one move at a time: it records the
+// destination node as a pending owner of the shard, without exposing it
+// to writers, until the data copy completes out-of-band. It deliberately
+// doesn't touch the live Owners list itself — call CommitRebalanceMove
+// once the data node reports the copy has landed, so a crash mid-move
+// never leaves a shard exposed to writes before it has the data. If
+// opts.DryRun is set, ApplyRebalance returns nil immediately without
+// touching any shard, so a plan fetched for display can be passed
+// straight through instead of the caller checking DryRun itself.
+func (c *Client) ApplyRebalance(plan []ShardMove, opts RebalanceOptions) error {
+	if opts.DryRun {
+		return nil
+	}
+
+	for _, mv := range plan {
+		if err := c.AddPendingShardOwner(mv.ShardID, mv.ToNodeID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CommitRebalanceMove finishes a single move planned by PlanRebalance and
+// started by ApplyRebalance, once the data copy to ToNodeID has landed:
+// it commits the pending owner and removes the source as an owner of the
+// shard.
+func (c *Client) CommitRebalanceMove(mv ShardMove) error {
+	if err := c.CommitPendingShardOwner(mv.ShardID, mv.ToNodeID); err != nil {
+		return err
+	}
+	return c.RemoveShardOwner(mv.ShardID, mv.FromNodeID)
+}
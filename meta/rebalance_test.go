@@ -0,0 +1,108 @@
+package meta
+
+import (
+	"testing"
+
+	"github.com/influxdata/influxdb/services/meta"
+)
+
+// TestData_PlanRebalance_NeverDoublesUpOnSameDestination reproduces a
+// freshly added, empty node C alongside two already-loaded nodes A and
+// B that jointly own every shard (replicaN=2). A naive plan would move
+// both A's and B's replica of the same shard onto C, landing two
+// replicas of one shard on one node; PlanRebalance must instead exclude
+// C once the first owner's move has claimed it.
+func TestData_PlanRebalance_NeverDoublesUpOnSameDestination(t *testing.T) {
+	data := &Data{Data: &meta.Data{}}
+	for _, host := range []string{"hostA", "hostB", "hostC"} {
+		if err := data.CreateDataNode(host, host+":8088"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b := uint64(1), uint64(2)
+
+	if err := data.Data.CreateDatabase("db0"); err != nil {
+		t.Fatal(err)
+	}
+	rpi := meta.NewRetentionPolicyInfo("autogen")
+	rpi.ReplicaN = 2
+	if err := data.Data.CreateRetentionPolicy("db0", rpi, true); err != nil {
+		t.Fatal(err)
+	}
+	rpi, err := data.Data.RetentionPolicy("db0", "autogen")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const numShards = 10
+	shards := make([]meta.ShardInfo, numShards)
+	for i := range shards {
+		shards[i] = meta.ShardInfo{
+			ID:     uint64(100 + i),
+			Owners: []meta.ShardOwner{{NodeID: a}, {NodeID: b}},
+		}
+	}
+	rpi.ShardGroups = append(rpi.ShardGroups, meta.ShardGroupInfo{ID: 1, Shards: shards})
+
+	moves := data.PlanRebalance(RebalanceOptions{})
+
+	seen := make(map[uint64]map[uint64]bool, numShards)
+	for _, mv := range moves {
+		if mv.FromNodeID == mv.ToNodeID {
+			t.Fatalf("move %+v: FromNodeID == ToNodeID", mv)
+		}
+		if seen[mv.ShardID] == nil {
+			seen[mv.ShardID] = make(map[uint64]bool)
+		}
+		if seen[mv.ShardID][mv.ToNodeID] {
+			t.Fatalf("shard %d planned to move onto node %d twice, co-locating two replicas", mv.ShardID, mv.ToNodeID)
+		}
+		seen[mv.ShardID][mv.ToNodeID] = true
+	}
+}
+
+func TestClient_ApplyRebalance_DryRunIsANoOp(t *testing.T) {
+	c := &Client{}
+	plan := []ShardMove{{ShardID: 1, FromNodeID: 1, ToNodeID: 2}}
+
+	// A DryRun call must return before touching the network (c has no
+	// metaServers/localStore configured, so any real attempt to apply
+	// a move would error or panic).
+	if err := c.ApplyRebalance(plan, RebalanceOptions{DryRun: true}); err != nil {
+		t.Fatalf("ApplyRebalance (dry run): %s", err)
+	}
+}
+
+// TestClient_ApplyRebalance_DoesNotExposeDestinationBeforeCommit exercises
+// the non-dry-run path end to end through a co-located localStore (see
+// newMoveShardTestStore), the same seam TestStore_MoveShard uses. It
+// asserts ApplyRebalance only records a pending owner — never a live one
+// — until CommitRebalanceMove runs, the exact hazard the review flagged
+// for the old AddShardOwner-then-AddPendingShardOwner ordering.
+func TestClient_ApplyRebalance_DoesNotExposeDestinationBeforeCommit(t *testing.T) {
+	data, shardID := newShardTestData(t, 3, 1)
+	s := newMoveShardTestStore(data)
+
+	c := NewClient(&MetaConfig{})
+	c.capabilities = map[Capability]bool{CapabilityShardPendingOwners: true}
+	c.SetStore(&Store{store: s})
+
+	plan := []ShardMove{{ShardID: shardID, FromNodeID: 1, ToNodeID: 2}}
+	if err := c.ApplyRebalance(plan, RebalanceOptions{}); err != nil {
+		t.Fatalf("ApplyRebalance: %s", err)
+	}
+
+	if ids := shardOwnerIDs(t, s.data, shardID); len(ids) != 1 || ids[0] != 1 {
+		t.Fatalf("owners after ApplyRebalance = %v, want [1] (destination must not be live yet)", ids)
+	}
+	if !hasPendingShardOwner(s.data.DataNode(2), shardID) {
+		t.Fatal("expected node 2 to have a pending shard owner entry after ApplyRebalance")
+	}
+
+	if err := c.CommitRebalanceMove(plan[0]); err != nil {
+		t.Fatalf("CommitRebalanceMove: %s", err)
+	}
+	if ids := shardOwnerIDs(t, s.data, shardID); len(ids) != 1 || ids[0] != 2 {
+		t.Fatalf("owners after CommitRebalanceMove = %v, want [2]", ids)
+	}
+}
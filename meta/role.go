@@ -0,0 +1,367 @@
+package meta
+
+import (
+	"github.com/gogo/protobuf/proto"
+	"github.com/influxdata/influxdb/influxql"
+	"github.com/zhexuany/influxdb-cluster/meta/internal"
+)
+
+// RoleInfo is a named bundle of per-database privileges, and optionally
+// cluster admin, that can be granted to many users at once instead of
+// setting the same privilege on each of them individually.
+type RoleInfo struct {
+	Name string
+
+	// Users is the set of usernames currently members of this role.
+	Users []string
+
+	// Privileges maps database name to the privilege this role grants
+	// its members on it.
+	Privileges map[string]influxql.Privilege
+
+	// Admin, if true, grants cluster admin to every member of this
+	// role, the same way UserInfo.Admin does for a single user.
+	Admin bool
+}
+
+// HasUser reports whether name is a member of r.
+func (r *RoleInfo) HasUser(name string) bool {
+	for _, u := range r.Users {
+		if u == name {
+			return true
+		}
+	}
+	return false
+}
+
+// clone returns a copy of r, deep enough that mutating the copy's Users
+// or Privileges never touches r's.
+func (r RoleInfo) clone() RoleInfo {
+	other := r
+	other.Users = append([]string(nil), r.Users...)
+	other.Privileges = make(map[string]influxql.Privilege, len(r.Privileges))
+	for db, p := range r.Privileges {
+		other.Privileges[db] = p
+	}
+	return other
+}
+
+// marshal serializes to a protobuf representation.
+func (r RoleInfo) marshal() *internal.RoleInfo {
+	pb := &internal.RoleInfo{}
+	pb.Name = proto.String(r.Name)
+	pb.Users = append([]string(nil), r.Users...)
+	pb.Admin = proto.Bool(r.Admin)
+
+	for db, p := range r.Privileges {
+		pb.Privileges = append(pb.Privileges, &internal.RolePrivilege{
+			Database:  proto.String(db),
+			Privilege: proto.Int32(int32(p)),
+		})
+	}
+	return pb
+}
+
+// unmarshal deserializes from a protobuf representation.
+func (r *RoleInfo) unmarshal(pb *internal.RoleInfo) {
+	r.Name = pb.GetName()
+	r.Users = pb.GetUsers()
+	r.Admin = pb.GetAdmin()
+
+	r.Privileges = make(map[string]influxql.Privilege, len(pb.GetPrivileges()))
+	for _, p := range pb.GetPrivileges() {
+		r.Privileges[p.GetDatabase()] = influxql.Privilege(p.GetPrivilege())
+	}
+}
+
+// Role returns the role named name, or nil if it doesn't exist.
+func (data *Data) Role(name string) *RoleInfo {
+	for i := range data.Roles {
+		if data.Roles[i].Name == name {
+			return &data.Roles[i]
+		}
+	}
+	return nil
+}
+
+// CreateRole creates a new, empty role named name.
+func (data *Data) CreateRole(name string) error {
+	if data.Role(name) != nil {
+		return ErrRoleExists
+	}
+
+	data.Roles = append(data.Roles, RoleInfo{Name: name, Privileges: make(map[string]influxql.Privilege)})
+	return nil
+}
+
+// DropRole removes the role named name. It's a no-op if the role
+// doesn't exist, the same as Data's other Drop* methods.
+func (data *Data) DropRole(name string) error {
+	for i := range data.Roles {
+		if data.Roles[i].Name == name {
+			data.Roles = append(data.Roles[:i], data.Roles[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+// ChangeRoleName renames role oldName to newName.
+func (data *Data) ChangeRoleName(oldName, newName string) error {
+	if data.Role(newName) != nil {
+		return ErrRoleExists
+	}
+	r := data.Role(oldName)
+	if r == nil {
+		return ErrRoleNotFound
+	}
+	r.Name = newName
+	return nil
+}
+
+// AddRoleUsers adds users to role name. A user already in the role is
+// left alone rather than duplicated.
+func (data *Data) AddRoleUsers(name string, users []string) error {
+	r := data.Role(name)
+	if r == nil {
+		return ErrRoleNotFound
+	}
+
+	for _, u := range users {
+		if data.User(u) == nil {
+			return ErrUserNotFound
+		}
+		if !r.HasUser(u) {
+			r.Users = append(r.Users, u)
+		}
+	}
+	return nil
+}
+
+// RemoveRoleUsers removes users from role name. Removing a user who
+// isn't a member is a no-op.
+func (data *Data) RemoveRoleUsers(name string, users []string) error {
+	r := data.Role(name)
+	if r == nil {
+		return ErrRoleNotFound
+	}
+
+	remove := make(map[string]bool, len(users))
+	for _, u := range users {
+		remove[u] = true
+	}
+
+	kept := r.Users[:0]
+	for _, u := range r.Users {
+		if !remove[u] {
+			kept = append(kept, u)
+		}
+	}
+	r.Users = kept
+	return nil
+}
+
+// SetRolePrivilege grants role name privilege p on database.
+func (data *Data) SetRolePrivilege(name, database string, p influxql.Privilege) error {
+	r := data.Role(name)
+	if r == nil {
+		return ErrRoleNotFound
+	}
+	if r.Privileges == nil {
+		r.Privileges = make(map[string]influxql.Privilege)
+	}
+	r.Privileges[database] = p
+	return nil
+}
+
+// SetRoleAdminPrivilege grants or revokes cluster admin on role name.
+func (data *Data) SetRoleAdminPrivilege(name string, admin bool) error {
+	r := data.Role(name)
+	if r == nil {
+		return ErrRoleNotFound
+	}
+	r.Admin = admin
+	return nil
+}
+
+// UserPrivilege returns username's effective privilege on database: the
+// union of their direct grant (see the embedded meta.Data's
+// UserPrivilege) and whatever their role memberships grant. Read and
+// Write together make All; otherwise the higher privilege wins.
+func (data *Data) UserPrivilege(username, database string) (*influxql.Privilege, error) {
+	p, err := data.Data.UserPrivilege(username, database)
+	if err != nil {
+		return nil, err
+	}
+
+	effective := influxql.NoPrivileges
+	if p != nil {
+		effective = *p
+	}
+
+	for i := range data.Roles {
+		r := &data.Roles[i]
+		if !r.HasUser(username) {
+			continue
+		}
+		rp, ok := r.Privileges[database]
+		if !ok {
+			continue
+		}
+		if (effective == influxql.ReadPrivilege && rp == influxql.WritePrivilege) ||
+			(effective == influxql.WritePrivilege && rp == influxql.ReadPrivilege) {
+			effective = influxql.AllPrivileges
+		} else if rp > effective {
+			effective = rp
+		}
+	}
+
+	return &effective, nil
+}
+
+// UserPrivileges returns every database username has a privilege on,
+// with the effective privilege on each: the union of their direct
+// grants and whatever their role memberships grant, combined the same
+// way as UserPrivilege.
+func (data *Data) UserPrivileges(username string) (map[string]influxql.Privilege, error) {
+	privileges, err := data.Data.UserPrivileges(username)
+	if err != nil {
+		return nil, err
+	}
+	if privileges == nil {
+		privileges = make(map[string]influxql.Privilege)
+	}
+
+	for i := range data.Roles {
+		r := &data.Roles[i]
+		if !r.HasUser(username) {
+			continue
+		}
+		for db, p := range r.Privileges {
+			existing, ok := privileges[db]
+			if !ok {
+				privileges[db] = p
+			} else if (existing == influxql.ReadPrivilege && p == influxql.WritePrivilege) ||
+				(existing == influxql.WritePrivilege && p == influxql.ReadPrivilege) {
+				privileges[db] = influxql.AllPrivileges
+			} else if p > existing {
+				privileges[db] = p
+			}
+		}
+	}
+
+	return privileges, nil
+}
+
+// UserIsAdmin reports whether username is a cluster admin, either
+// directly (UserInfo.Admin) or through membership in an admin role.
+func (data *Data) UserIsAdmin(username string) bool {
+	if u := data.User(username); u != nil && u.Admin {
+		return true
+	}
+	for i := range data.Roles {
+		r := &data.Roles[i]
+		if r.Admin && r.HasUser(username) {
+			return true
+		}
+	}
+	return false
+}
+
+// Client-facing RBAC API. Every mutation is a command submitted through
+// retryUntilExec, the same as the rest of Client's write paths; SHOW
+// ROLES/GRANT ROLE statement parsing belongs to the query layer (not
+// present in this package) and just needs to call down to these.
+
+// Roles returns every role in the cluster.
+func (c *Client) Roles() []RoleInfo {
+	roles := c.data().Roles
+	if roles == nil {
+		return []RoleInfo{}
+	}
+	return roles
+}
+
+// Role returns the role named name.
+func (c *Client) Role(name string) (*RoleInfo, error) {
+	if r := c.data().Role(name); r != nil {
+		clone := r.clone()
+		return &clone, nil
+	}
+	return nil, ErrRoleNotFound
+}
+
+// CreateRole creates a new, empty role named name.
+func (c *Client) CreateRole(name string) error {
+	return c.retryUntilExec(internal.Command_CreateRoleCommand, internal.E_CreateRoleCommand_Command,
+		&internal.CreateRoleCommand{
+			Name: proto.String(name),
+		},
+	)
+}
+
+// DropRole removes the role named name.
+func (c *Client) DropRole(name string) error {
+	return c.retryUntilExec(internal.Command_DropRoleCommand, internal.E_DropRoleCommand_Command,
+		&internal.DropRoleCommand{
+			Name: proto.String(name),
+		},
+	)
+}
+
+// ChangeRoleName renames role oldName to newName.
+func (c *Client) ChangeRoleName(oldName, newName string) error {
+	return c.retryUntilExec(internal.Command_ChangeRoleNameCommand, internal.E_ChangeRoleNameCommand_Command,
+		&internal.ChangeRoleNameCommand{
+			OldName: proto.String(oldName),
+			NewName: proto.String(newName),
+		},
+	)
+}
+
+// AddRoleUsers adds users to role name.
+func (c *Client) AddRoleUsers(name string, users []string) error {
+	return c.retryUntilExec(internal.Command_AddRoleUsersCommand, internal.E_AddRoleUsersCommand_Command,
+		&internal.AddRoleUsersCommand{
+			Name:  proto.String(name),
+			Users: users,
+		},
+	)
+}
+
+// RemoveRoleUsers removes users from role name.
+func (c *Client) RemoveRoleUsers(name string, users []string) error {
+	return c.retryUntilExec(internal.Command_RemoveRoleUsersCommand, internal.E_RemoveRoleUsersCommand_Command,
+		&internal.RemoveRoleUsersCommand{
+			Name:  proto.String(name),
+			Users: users,
+		},
+	)
+}
+
+// SetRolePrivilege grants role name privilege p on database.
+func (c *Client) SetRolePrivilege(name, database string, p influxql.Privilege) error {
+	return c.retryUntilExec(internal.Command_SetRolePrivilegeCommand, internal.E_SetRolePrivilegeCommand_Command,
+		&internal.SetRolePrivilegeCommand{
+			Name:      proto.String(name),
+			Database:  proto.String(database),
+			Privilege: proto.Int32(int32(p)),
+		},
+	)
+}
+
+// SetRoleAdminPrivilege grants or revokes cluster admin on role name.
+func (c *Client) SetRoleAdminPrivilege(name string, admin bool) error {
+	return c.retryUntilExec(internal.Command_SetRoleAdminPrivilegeCommand, internal.E_SetRoleAdminPrivilegeCommand_Command,
+		&internal.SetRoleAdminPrivilegeCommand{
+			Name:  proto.String(name),
+			Admin: proto.Bool(admin),
+		},
+	)
+}
+
+// UserIsAdmin reports whether username is a cluster admin, either
+// directly or through an admin role.
+func (c *Client) UserIsAdmin(username string) bool {
+	return c.data().UserIsAdmin(username)
+}
@@ -0,0 +1,174 @@
+package meta
+
+import (
+	"testing"
+
+	"github.com/influxdata/influxdb/influxql"
+	"github.com/influxdata/influxdb/services/meta"
+)
+
+func newRoleTestData(t *testing.T) *Data {
+	t.Helper()
+
+	data := &Data{Data: &meta.Data{}}
+	if err := data.Data.CreateUser("alice", "x", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.Data.CreateUser("bob", "x", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.Data.CreateDatabase("db0"); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestData_CreateRole(t *testing.T) {
+	data := newRoleTestData(t)
+
+	if err := data.CreateRole("readers"); err != nil {
+		t.Fatalf("CreateRole: %s", err)
+	}
+	if data.Role("readers") == nil {
+		t.Fatal("expected role to exist")
+	}
+	if err := data.CreateRole("readers"); err != ErrRoleExists {
+		t.Fatalf("CreateRole duplicate: got %v, want ErrRoleExists", err)
+	}
+}
+
+func TestData_AddRoleUsers_UnknownRoleOrUser(t *testing.T) {
+	data := newRoleTestData(t)
+
+	if err := data.AddRoleUsers("readers", []string{"alice"}); err != ErrRoleNotFound {
+		t.Fatalf("got %v, want ErrRoleNotFound", err)
+	}
+
+	if err := data.CreateRole("readers"); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.AddRoleUsers("readers", []string{"nobody"}); err != ErrUserNotFound {
+		t.Fatalf("got %v, want ErrUserNotFound", err)
+	}
+}
+
+func TestData_UserPrivilege_UnionsRoleGrants(t *testing.T) {
+	data := newRoleTestData(t)
+
+	if err := data.Data.SetPrivilege("alice", "db0", influxql.ReadPrivilege); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.CreateRole("writers"); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.SetRolePrivilege("writers", "db0", influxql.WritePrivilege); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.AddRoleUsers("writers", []string{"alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := data.UserPrivilege("alice", "db0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *p != influxql.AllPrivileges {
+		t.Fatalf("UserPrivilege = %v, want %v", *p, influxql.AllPrivileges)
+	}
+
+	// bob has no direct grant and isn't in the role, so he gets nothing.
+	p, err = data.UserPrivilege("bob", "db0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *p != influxql.NoPrivileges {
+		t.Fatalf("UserPrivilege = %v, want %v", *p, influxql.NoPrivileges)
+	}
+}
+
+func TestData_UserIsAdmin_ViaRole(t *testing.T) {
+	data := newRoleTestData(t)
+
+	if err := data.CreateRole("admins"); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.SetRoleAdminPrivilege("admins", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.AddRoleUsers("admins", []string{"bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !data.UserIsAdmin("bob") {
+		t.Fatal("expected bob to be admin via role membership")
+	}
+	if data.UserIsAdmin("alice") {
+		t.Fatal("alice is not a member of admins and has no direct admin grant")
+	}
+}
+
+func TestData_RemoveRoleUsers(t *testing.T) {
+	data := newRoleTestData(t)
+
+	if err := data.CreateRole("readers"); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.AddRoleUsers("readers", []string{"alice", "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.RemoveRoleUsers("readers", []string{"alice"}); err != nil {
+		t.Fatalf("RemoveRoleUsers: %s", err)
+	}
+
+	r := data.Role("readers")
+	if r.HasUser("alice") {
+		t.Fatal("alice should have been removed")
+	}
+	if !r.HasUser("bob") {
+		t.Fatal("bob should still be a member")
+	}
+}
+
+// TestData_Roles_SnapshotRoundTrip confirms role membership and privileges
+// survive a MarshalBinary/UnmarshalBinary round trip, i.e. Raft snapshot
+// and restore.
+func TestData_Roles_SnapshotRoundTrip(t *testing.T) {
+	data := newRoleTestData(t)
+
+	if err := data.CreateRole("writers"); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.SetRolePrivilege("writers", "db0", influxql.WritePrivilege); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.SetRoleAdminPrivilege("writers", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.AddRoleUsers("writers", []string{"alice", "bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := data.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %s", err)
+	}
+
+	restored := &Data{}
+	if err := restored.UnmarshalBinary(buf); err != nil {
+		t.Fatalf("UnmarshalBinary: %s", err)
+	}
+
+	r := restored.Role("writers")
+	if r == nil {
+		t.Fatal("role did not survive the round trip")
+	}
+	if !r.Admin {
+		t.Error("role admin privilege did not survive the round trip")
+	}
+	if !r.HasUser("alice") || !r.HasUser("bob") {
+		t.Errorf("role users = %v, want [alice bob]", r.Users)
+	}
+	if got := r.Privileges["db0"]; got != influxql.WritePrivilege {
+		t.Errorf("role privilege on db0 = %v, want %v", got, influxql.WritePrivilege)
+	}
+}
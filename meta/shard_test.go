@@ -0,0 +1,170 @@
+package meta
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/influxdata/influxdb/services/meta"
+)
+
+// newShardTestData builds a *Data with nodes data nodes and a single
+// shard owned by firstOwners, ready for AddShardOwner/RemoveShardOwner
+// tests.
+func newShardTestData(t *testing.T, nodes int, firstOwners ...uint64) (*Data, uint64) {
+	t.Helper()
+
+	data := &Data{Data: &meta.Data{}}
+	for i := 0; i < nodes; i++ {
+		host := fmt.Sprintf("host%d", i)
+		if err := data.CreateDataNode(host, host+":8088"); err != nil {
+			t.Fatalf("CreateDataNode: %s", err)
+		}
+	}
+
+	if err := data.Data.CreateDatabase("db0"); err != nil {
+		t.Fatal(err)
+	}
+	rpi := meta.NewRetentionPolicyInfo("autogen")
+	if err := data.Data.CreateRetentionPolicy("db0", rpi, true); err != nil {
+		t.Fatal(err)
+	}
+
+	owners := make([]meta.ShardOwner, len(firstOwners))
+	for i, id := range firstOwners {
+		owners[i] = meta.ShardOwner{NodeID: id}
+	}
+
+	rpi, err := data.Data.RetentionPolicy("db0", "autogen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpi.ShardGroups = append(rpi.ShardGroups, meta.ShardGroupInfo{
+		ID:     1,
+		Shards: []meta.ShardInfo{{ID: 42, Owners: owners}},
+	})
+
+	return data, 42
+}
+
+func shardOwnerIDs(t *testing.T, data *Data, shardID uint64) []uint64 {
+	t.Helper()
+	si, err := data.ShardLocation(shardID)
+	if err != nil {
+		t.Fatalf("ShardLocation: %s", err)
+	}
+	ids := make([]uint64, len(si.Owners))
+	for i, o := range si.Owners {
+		ids[i] = o.NodeID
+	}
+	return ids
+}
+
+func TestData_AddShardOwner(t *testing.T) {
+	tests := []struct {
+		name       string
+		nodes      int
+		initial    []uint64
+		add        uint64
+		wantErr    error
+		wantOwners []uint64
+	}{
+		{name: "add a new owner", nodes: 3, initial: []uint64{1}, add: 2, wantOwners: []uint64{1, 2}},
+		{name: "add an existing owner is a no-op", nodes: 3, initial: []uint64{1, 2}, add: 2, wantOwners: []uint64{1, 2}},
+		{name: "add an unknown node is rejected", nodes: 2, initial: []uint64{1}, add: 99, wantErr: ErrNodeNotFound, wantOwners: []uint64{1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, shardID := newShardTestData(t, tt.nodes, tt.initial...)
+
+			err := data.AddShardOwner(shardID, tt.add)
+			if tt.wantErr != nil {
+				if err != tt.wantErr {
+					t.Fatalf("AddShardOwner: got err %v, want %v", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("AddShardOwner: %s", err)
+			}
+
+			got := shardOwnerIDs(t, data, shardID)
+			if len(got) != len(tt.wantOwners) {
+				t.Fatalf("owners = %v, want %v", got, tt.wantOwners)
+			}
+			want := make(map[uint64]bool, len(tt.wantOwners))
+			for _, id := range tt.wantOwners {
+				want[id] = true
+			}
+			for _, id := range got {
+				if !want[id] {
+					t.Errorf("owners = %v, want %v", got, tt.wantOwners)
+				}
+			}
+		})
+	}
+}
+
+func TestData_RemoveShardOwner(t *testing.T) {
+	tests := []struct {
+		name       string
+		initial    []uint64
+		remove     uint64
+		wantOwners []uint64
+	}{
+		{name: "remove an owner", initial: []uint64{1, 2}, remove: 2, wantOwners: []uint64{1}},
+		{name: "remove a non-owner is a no-op", initial: []uint64{1}, remove: 2, wantOwners: []uint64{1}},
+		{name: "remove the last owner leaves the shard unowned", initial: []uint64{1}, remove: 1, wantOwners: []uint64{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, shardID := newShardTestData(t, 3, tt.initial...)
+
+			if err := data.RemoveShardOwner(shardID, tt.remove); err != nil {
+				t.Fatalf("RemoveShardOwner: %s", err)
+			}
+
+			got := shardOwnerIDs(t, data, shardID)
+			if len(got) != len(tt.wantOwners) {
+				t.Fatalf("owners = %v, want %v", got, tt.wantOwners)
+			}
+		})
+	}
+}
+
+func TestData_RemoveShardOwner_MutatesUnderlyingShardGroup(t *testing.T) {
+	// Regression test: ShardLocation used to return a range-loop copy,
+	// so PruneShard's edits never made it back into
+	// Databases[...].RetentionPolicies[...].ShardGroups[...].Shards[...].
+	data, shardID := newShardTestData(t, 2, 1, 2)
+
+	if err := data.RemoveShardOwner(shardID, 1); err != nil {
+		t.Fatalf("RemoveShardOwner: %s", err)
+	}
+
+	rpi, err := data.Data.RetentionPolicy("db0", "autogen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners := rpi.ShardGroups[0].Shards[0].Owners
+	if len(owners) != 1 || owners[0].NodeID != 2 {
+		t.Fatalf("underlying shard group owners = %v, want [{NodeID:2}]", owners)
+	}
+}
+
+func TestData_DeleteDataNode_ReassignsOrphanedShardOwner(t *testing.T) {
+	data, shardID := newShardTestData(t, 3, 1, 2)
+
+	if err := data.DeleteDataNode(1); err != nil {
+		t.Fatalf("DeleteDataNode: %s", err)
+	}
+
+	got := shardOwnerIDs(t, data, shardID)
+	if len(got) != 2 {
+		t.Fatalf("owners after DeleteDataNode = %v, want 2 owners (replacement for the removed node)", got)
+	}
+	for _, id := range got {
+		if id == 1 {
+			t.Errorf("owners = %v, still includes deleted node 1", got)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package meta
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/influxdata/influxdb/services/meta"
+)
+
+// newMoveShardTestStore returns a *store whose Apply drives a real
+// storeFSM directly (see store.applyFn), so MoveShard's sequence of
+// proposeShardOwnerCommand calls exercises the same dispatch table and
+// Data mutations raft would, without the cost of standing up a
+// single-node raft cluster for this test.
+func newMoveShardTestStore(data *Data) *store {
+	s := &store{data: data, config: &MetaConfig{}}
+	fsm := (*storeFSM)(s)
+	s.applyFn = func(b []byte) error {
+		if err, ok := fsm.Apply(&raft.Log{Data: b}).(error); ok {
+			return err
+		}
+		return nil
+	}
+	return s
+}
+
+func TestData_MoveShard_PendingAndCommitLifecycle(t *testing.T) {
+	data, shardID := newShardTestData(t, 3, 1)
+
+	if err := data.AddPendingShardOwner(shardID, 2); err != nil {
+		t.Fatalf("AddPendingShardOwner: %s", err)
+	}
+	if !hasPendingShardOwner(data.DataNode(2), shardID) {
+		t.Fatal("expected node 2 to have a pending shard owner entry")
+	}
+
+	// A shard that's still mid-copy isn't a live owner yet.
+	if ids := shardOwnerIDs(t, data, shardID); len(ids) != 1 || ids[0] != 1 {
+		t.Fatalf("owners before commit = %v, want [1]", ids)
+	}
+
+	if err := data.CommitPendingShardOwner(shardID, 2); err != nil {
+		t.Fatalf("CommitPendingShardOwner: %s", err)
+	}
+	if hasPendingShardOwner(data.DataNode(2), shardID) {
+		t.Fatal("pending entry should be cleared once committed")
+	}
+
+	ids := shardOwnerIDs(t, data, shardID)
+	if len(ids) != 2 {
+		t.Fatalf("owners after commit = %v, want 2 owners", ids)
+	}
+
+	if err := data.RemoveShardOwner(shardID, 1); err != nil {
+		t.Fatalf("RemoveShardOwner: %s", err)
+	}
+	if ids := shardOwnerIDs(t, data, shardID); len(ids) != 1 || ids[0] != 2 {
+		t.Fatalf("owners after decommissioning the source = %v, want [2]", ids)
+	}
+}
+
+// TestStore_MoveShard_DoesNotExposeDestinationBeforeCopy drives an
+// actual store.MoveShard call and asserts that, while CopyShard is
+// running (simulating a copy still in flight under load), the
+// destination node shows up only as a pending owner and never as a live
+// one — the exact hazard the review flagged: exposing an empty shard to
+// writers before its data has landed.
+func TestStore_MoveShard_DoesNotExposeDestinationBeforeCopy(t *testing.T) {
+	data, shardID := newShardTestData(t, 3, 1)
+	s := newMoveShardTestStore(data)
+
+	copyStarted := make(chan struct{})
+	releaseCopy := make(chan struct{})
+	s.CopyShard = func(shardID, fromNodeID, toNodeID uint64) error {
+		close(copyStarted)
+		<-releaseCopy
+		return nil
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.MoveShard(shardID, 1, 2) }()
+
+	<-copyStarted
+	if ids := shardOwnerIDs(t, s.data, shardID); len(ids) != 1 || ids[0] != 1 {
+		t.Fatalf("owners mid-copy = %v, want [1] (destination must not be live yet)", ids)
+	}
+	if !hasPendingShardOwner(s.data.DataNode(2), shardID) {
+		t.Fatal("expected node 2 to have a pending shard owner entry mid-copy")
+	}
+
+	close(releaseCopy)
+	if err := <-done; err != nil {
+		t.Fatalf("MoveShard: %s", err)
+	}
+
+	if ids := shardOwnerIDs(t, s.data, shardID); len(ids) != 1 || ids[0] != 2 {
+		t.Fatalf("owners after MoveShard = %v, want [2]", ids)
+	}
+	if hasPendingShardOwner(s.data.DataNode(2), shardID) {
+		t.Fatal("pending entry should be cleared once MoveShard commits")
+	}
+}
+
+func TestData_CommitPendingShardOwner_NotPending(t *testing.T) {
+	data, shardID := newShardTestData(t, 2, 1)
+
+	if err := data.CommitPendingShardOwner(shardID, 2); err != ErrShardNotFound {
+		t.Fatalf("got %v, want ErrShardNotFound", err)
+	}
+}
+
+func TestData_AddPendingShardOwner_UnknownNode(t *testing.T) {
+	data, shardID := newShardTestData(t, 1, 1)
+
+	if err := data.AddPendingShardOwner(shardID, 99); err != ErrNodeNotFound {
+		t.Fatalf("got %v, want ErrNodeNotFound", err)
+	}
+}
+
+func hasPendingShardOwner(node *NodeInfo, shardID uint64) bool {
+	for _, id := range node.PendingShardOwners {
+		if id == shardID {
+			return true
+		}
+	}
+	return false
+}
+
+func TestData_CreateBalancedShardGroup_SpreadsLoad(t *testing.T) {
+	data := &Data{Data: &meta.Data{}}
+	for i := 0; i < 3; i++ {
+		host := []string{"host0", "host1", "host2"}[i]
+		if err := data.CreateDataNode(host, host+":8088"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := data.Data.CreateDatabase("db0"); err != nil {
+		t.Fatal(err)
+	}
+	rpi := meta.NewRetentionPolicyInfo("autogen")
+	rpi.ReplicaN = 1
+	rpi.ShardGroupDuration = time.Hour
+	if err := data.Data.CreateRetentionPolicy("db0", rpi, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Give node 1 a head start so a round-robin/hash placer would keep
+	// piling onto it, but a load-aware placer shouldn't.
+	rpi, err := data.Data.RetentionPolicy("db0", "autogen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node1 := data.DataNode(1)
+	rpi.ShardGroups = append(rpi.ShardGroups, meta.ShardGroupInfo{
+		ID:        100,
+		StartTime: time.Unix(0, 0),
+		EndTime:   time.Unix(0, 0).Add(time.Hour),
+		Shards: []meta.ShardInfo{
+			{ID: 200, Owners: []meta.ShardOwner{{NodeID: node1.ID}}},
+			{ID: 201, Owners: []meta.ShardOwner{{NodeID: node1.ID}}},
+		},
+	})
+
+	if err := data.CreateBalancedShardGroup("db0", "autogen", time.Unix(0, 0).Add(2*time.Hour)); err != nil {
+		t.Fatalf("CreateBalancedShardGroup: %s", err)
+	}
+
+	sg := rpi.ShardGroupByTimestamp(time.Unix(0, 0).Add(2 * time.Hour))
+	if sg == nil {
+		t.Fatal("expected a new shard group")
+	}
+	for _, sh := range sg.Shards {
+		for _, o := range sh.Owners {
+			if o.NodeID == node1.ID {
+				t.Errorf("shard %d landed on the already-overloaded node %d", sh.ID, o.NodeID)
+			}
+		}
+	}
+}
+
+func TestData_TruncateShardsGrops(t *testing.T) {
+	data := &Data{Data: &meta.Data{}}
+	sg := &meta.ShardGroupInfo{
+		ID:        1,
+		StartTime: time.Unix(0, 0),
+		EndTime:   time.Unix(0, 0).Add(time.Hour),
+	}
+
+	mid := time.Unix(0, 0).Add(30 * time.Minute)
+	if err := data.TruncateShardsGrops(sg, mid); err != nil {
+		t.Fatalf("TruncateShardsGrops: %s", err)
+	}
+	if !sg.EndTime.Equal(mid) {
+		t.Fatalf("EndTime = %v, want %v", sg.EndTime, mid)
+	}
+
+	// A timestamp outside the group's window is a no-op.
+	after := time.Unix(0, 0).Add(2 * time.Hour)
+	if err := data.TruncateShardsGrops(sg, after); err != nil {
+		t.Fatalf("TruncateShardsGrops: %s", err)
+	}
+	if !sg.EndTime.Equal(mid) {
+		t.Fatalf("EndTime changed to %v on an out-of-range truncate, want unchanged %v", sg.EndTime, mid)
+	}
+}
@@ -0,0 +1,121 @@
+package meta
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	"github.com/influxdata/influxdb/services/meta"
+)
+
+// writeLegacySnapshotForTest encodes b in the pre-v2 snapshot format
+// (length-prefixed gzip blob + trailing CRC32) so
+// TestData_ReadSnapshotFrom_LegacyFormat can exercise readLegacySnapshot
+// without depending on WriteSnapshotTo, which no longer produces it.
+func writeLegacySnapshotForTest(w *bytes.Buffer, b []byte) error {
+	var gzBuf bytes.Buffer
+	gz := gzip.NewWriter(&gzBuf)
+	if _, err := gz.Write(b); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	var sz [8]byte
+	binary.BigEndian.PutUint64(sz[:], uint64(gzBuf.Len()))
+	w.Write(sz[:])
+	w.Write(gzBuf.Bytes())
+
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(b))
+	w.Write(crc[:])
+	return nil
+}
+
+func newSnapshotTestData(t *testing.T) *Data {
+	t.Helper()
+
+	data := &Data{Data: &meta.Data{ClusterID: 42}}
+	if err := data.Data.CreateDatabase("db0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.CreateDataNode("host0", "host0:8088"); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.CreateRole("readers"); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestData_SnapshotRoundTrip(t *testing.T) {
+	data := newSnapshotTestData(t)
+
+	var buf bytes.Buffer
+	if err := data.WriteSnapshotTo(&buf); err != nil {
+		t.Fatalf("WriteSnapshotTo: %s", err)
+	}
+
+	var got Data
+	if err := got.ReadSnapshotFrom(&buf); err != nil {
+		t.Fatalf("ReadSnapshotFrom: %s", err)
+	}
+
+	if got.Data.ClusterID != 42 {
+		t.Fatalf("ClusterID = %d, want 42", got.Data.ClusterID)
+	}
+	if got.Data.Database("db0") == nil {
+		t.Fatal("expected db0 to survive the round trip")
+	}
+	if len(got.DataNodes) != 1 || got.DataNodes[0].Host != "host0" {
+		t.Fatalf("DataNodes = %v, want one node \"host0\"", got.DataNodes)
+	}
+	if got.Role("readers") == nil {
+		t.Fatal("expected role \"readers\" to survive the round trip")
+	}
+}
+
+func TestData_ReadSnapshotFrom_LegacyFormat(t *testing.T) {
+	data := newSnapshotTestData(t)
+
+	b, err := data.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var legacy bytes.Buffer
+	if err := writeLegacySnapshotForTest(&legacy, b); err != nil {
+		t.Fatal(err)
+	}
+
+	var got Data
+	if err := got.ReadSnapshotFrom(&legacy); err != nil {
+		t.Fatalf("ReadSnapshotFrom (legacy): %s", err)
+	}
+	if got.Data.ClusterID != 42 {
+		t.Fatalf("ClusterID = %d, want 42", got.Data.ClusterID)
+	}
+}
+
+func TestData_ReadSnapshotFrom_CorruptFrame(t *testing.T) {
+	data := newSnapshotTestData(t)
+
+	var buf bytes.Buffer
+	if err := data.WriteSnapshotTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	b := buf.Bytes()
+	// Flip a byte inside the first frame's payload, well past the
+	// magic/version/ClusterID header, to corrupt it without changing
+	// its length.
+	b[len(snapshotMagic)+1+8+10] ^= 0xff
+
+	var got Data
+	if err := got.ReadSnapshotFrom(bytes.NewReader(b)); err == nil {
+		t.Fatal("expected a checksum mismatch error, got nil")
+	}
+}
@@ -0,0 +1,396 @@
+package meta
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/gogo/protobuf/proto"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+	"github.com/zhexuany/influxdb-cluster/meta/internal"
+	"github.com/zhexuany/influxdb-cluster/tcp"
+)
+
+const (
+	// raftLogCacheSize is the maximum number of raft log entries kept in
+	// memory to avoid repeated disk reads for recently appended entries.
+	raftLogCacheSize = 512
+
+	// raftSnapshotsRetained is the number of snapshots kept on disk.
+	raftSnapshotsRetained = 2
+
+	// MaxRaftNodes is the maximum number of meta nodes allowed to
+	// participate in the raft cluster.
+	MaxRaftNodes = 3
+
+	raftDBName = "raft.db"
+
+	// leaderWaitTimeout is how long Store.Open waits for a leader to be
+	// elected before giving up and returning to the caller anyway; the
+	// client will simply retry against whichever node becomes leader.
+	leaderWaitTimeout = 30 * time.Second
+)
+
+// Store is an in-process, raft-backed meta store that can be embedded in a
+// node alongside Client. When a Client is co-located with a Store
+// (see Client.SetStore) and that Store is the raft leader, retryUntilExec
+// applies commands directly to the local Store instead of making a
+// network round-trip to a remote meta server.
+type Store struct {
+	*store
+}
+
+// store is the unexported implementation backing Store; storeFSM is defined
+// as `type storeFSM store` so the FSM methods in store_fsm.go can reach into
+// it directly.
+type store struct {
+	mu   sync.RWMutex
+	path string
+	addr string
+
+	data        *Data
+	dataChanged chan struct{}
+
+	config *MetaConfig
+
+	raft      *raft.Raft
+	transport *raft.NetworkTransport
+	peerLn    net.Listener
+
+	closing chan struct{}
+
+	// applyFn, if set, is used by Apply instead of proposing through
+	// s.raft. It exists so tests can exercise the orchestration in
+	// methods like MoveShard against a real storeFSM without paying for
+	// a full single-node raft cluster, the same way CopyShard lets
+	// tests stand in for the data-node-side copy.
+	applyFn func(b []byte) error
+
+	// CopyShard, if set, performs the actual TSM/WAL data copy for a
+	// shard move from fromNodeID to toNodeID. It's the hand-off point
+	// between this package's raft-replicated bookkeeping (pending
+	// owner, commit, decommission) and the data-node-side mechanics of
+	// streaming shard data, which live outside the meta package.
+	// MoveShard calls it synchronously after recording toNodeID as a
+	// pending owner and before committing it; leaving it nil commits
+	// the move immediately, which is only safe in tests.
+	CopyShard func(shardID, fromNodeID, toNodeID uint64) error
+
+	// metrics records storeFSM.Apply/Snapshot/Restore instrumentation
+	// (see newFSMMetrics). Always non-nil: a store built without a
+	// MetricsSink gets a blackhole sink instead of a nil check on every
+	// apply.
+	metrics *metrics.Metrics
+
+	// auditMu guards auditRing and auditLog (see appendAuditEntry), so
+	// Store.AuditLog can read the ring without taking s.mu.
+	// storeFSM.Apply calls appendAuditEntry while still holding s.mu, so
+	// a slow audit-log file write does hold up that Apply.
+	auditMu sync.Mutex
+
+	// auditRing is the bounded in-memory tail of AuditEntry records
+	// Store.AuditLog reads from; see appendAuditEntry.
+	auditRing []AuditEntry
+
+	// auditLog is the optional on-disk copy of auditRing, opened from
+	// MetaConfig.AuditLogPath if set. Nil disables the on-disk copy;
+	// the in-memory ring is still kept either way.
+	auditLog *os.File
+}
+
+// newFSMMetrics builds the *metrics.Metrics instance a store's FSM
+// reports to, wrapping sink (or a blackhole sink if sink is nil) the
+// same way Consul's agent wires an operator-supplied metrics.MetricSink
+// into its FSM.
+func newFSMMetrics(sink metrics.MetricSink) *metrics.Metrics {
+	if sink == nil {
+		sink = &metrics.BlackholeSink{}
+	}
+	conf := metrics.DefaultConfig("meta")
+	conf.EnableHostname = false
+	m, err := metrics.New(conf, sink)
+	if err != nil {
+		m, _ = metrics.New(conf, &metrics.BlackholeSink{})
+	}
+	return m
+}
+
+// NewStore returns a new Store backed by c.
+func NewStore(c *MetaConfig) *Store {
+	s := &store{
+		path:        c.Dir,
+		data:        &Data{},
+		dataChanged: make(chan struct{}),
+		config:      c,
+		closing:     make(chan struct{}),
+		metrics:     newFSMMetrics(c.MetricsSink),
+	}
+
+	if c.AuditLogPath != "" {
+		// Opened best-effort: a store still functions, signature
+		// verification included, without its on-disk audit copy.
+		if f, err := os.OpenFile(c.AuditLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640); err == nil {
+			s.auditLog = f
+		}
+	}
+
+	return &Store{store: s}
+}
+
+// Open starts the raft subsystem, bootstrapping a new single-node cluster
+// if peers is empty. With peers non-empty it starts raft without
+// bootstrapping; the addresses in peers are not contacted, and this node
+// takes part only once an existing leader adds it. mux is the *tcp.Mux the node's TCP listener is already being
+// served on; Open registers the MuxRaftHeader byte on it for raft traffic.
+func (s *store) Open(mux *tcp.Mux, peers []string) error {
+	if err := os.MkdirAll(s.path, 0777); err != nil {
+		return fmt.Errorf("mkdir all: %s", err)
+	}
+
+	s.peerLn = mux.Listen(tcp.MuxRaftHeader)
+
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(s.addr)
+
+	trans := raft.NewNetworkTransport(&raftStreamLayer{ln: s.peerLn, addr: s.addr}, 3, 10*time.Second, os.Stderr)
+	s.transport = trans
+
+	snapshots, err := raft.NewFileSnapshotStore(s.path, raftSnapshotsRetained, os.Stderr)
+	if err != nil {
+		return fmt.Errorf("file snapshot store: %s", err)
+	}
+
+	boltStore, err := raftboltdb.NewBoltStore(filepath.Join(s.path, raftDBName))
+	if err != nil {
+		return fmt.Errorf("raft bolt store: %s", err)
+	}
+
+	logStore, err := raft.NewLogCache(raftLogCacheSize, boltStore)
+	if err != nil {
+		return fmt.Errorf("raft log cache: %s", err)
+	}
+
+	r, err := raft.NewRaft(config, (*storeFSM)(s), logStore, boltStore, snapshots, trans)
+	if err != nil {
+		return fmt.Errorf("new raft: %s", err)
+	}
+	s.raft = r
+
+	if len(peers) == 0 {
+		cfg := raft.Configuration{Servers: []raft.Server{{
+			ID:      config.LocalID,
+			Address: trans.LocalAddr(),
+		}}}
+		r.BootstrapCluster(cfg)
+	}
+
+	deadline := time.Now().Add(leaderWaitTimeout)
+	for r.Leader() == "" && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	go s.runPrecreator()
+
+	return nil
+}
+
+// runPrecreator periodically extends shard group coverage ahead of
+// incoming writes, so a write landing exactly on a shard-group boundary
+// never has to wait on a raft round-trip to create one. Every node runs
+// the loop, but precreateShardGroups is a no-op unless this node is
+// currently the raft leader, so only one node in the cluster ever
+// proposes the commands.
+func (s *store) runPrecreator() {
+	interval := s.config.ShardGroupPrecreateCheckInterval
+	if interval <= 0 {
+		interval = DefaultShardGroupPrecreateCheckInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closing:
+			return
+		case <-ticker.C:
+			if !s.IsLeader() {
+				continue
+			}
+			s.precreateShardGroups()
+		}
+	}
+}
+
+// precreateShardGroups applies one CreateShardGroupCommand per shard
+// group Data.PrecreateShardGroups would create between now and the
+// configured advance period, so precreation is replicated through raft
+// like every other mutation instead of writing to s.data directly.
+func (s *store) precreateShardGroups() error {
+	advance := s.config.ShardGroupPrecreateAdvancePeriod
+	if advance <= 0 {
+		advance = DefaultShardGroupPrecreateAdvancePeriod
+	}
+
+	now := time.Now().UTC()
+
+	s.mu.RLock()
+	targets := s.data.planPrecreateShardGroups(now, now.Add(advance))
+	s.mu.RUnlock()
+
+	for _, t := range targets {
+		cmd := buildCommand(internal.Command_CreateShardGroupCommand, internal.E_CreateShardGroupCommand_Command,
+			&internal.CreateShardGroupCommand{
+				Database:  proto.String(t.Database),
+				Policy:    proto.String(t.Policy),
+				Timestamp: proto.Int64(t.Timestamp.UnixNano()),
+			},
+		)
+
+		b, err := proto.Marshal(cmd)
+		if err != nil {
+			return err
+		}
+		if err := s.Apply(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MoveShard performs a single two-phase shard move from fromNodeID to
+// toNodeID, the same primitives Client.ApplyRebalance/CommitRebalanceMove
+// use for a whole rebalance plan: it records toNodeID as a pending owner
+// without exposing it to writers, runs CopyShard (if set) to stream the
+// shard's data across, then commits the pending owner into Owners and
+// removes fromNodeID. Every step is proposed through raft via s.Apply, so
+// a crash mid-move leaves the shard at worst still pending on toNodeID,
+// never silently missing a live owner.
+func (s *store) MoveShard(shardID, fromNodeID, toNodeID uint64) error {
+	if err := s.proposeShardOwnerCommand(internal.Command_AddPendingShardOwnerCommand, internal.E_AddPendingShardOwnerCommand_Command,
+		&internal.AddPendingShardOwnerCommand{ID: proto.Uint64(shardID), NodeID: proto.Uint64(toNodeID)}); err != nil {
+		return err
+	}
+
+	if s.CopyShard != nil {
+		if err := s.CopyShard(shardID, fromNodeID, toNodeID); err != nil {
+			return err
+		}
+	}
+
+	if err := s.proposeShardOwnerCommand(internal.Command_CommitPendingShardOwnerCommand, internal.E_CommitPendingShardOwnerCommand_Command,
+		&internal.CommitPendingShardOwnerCommand{ID: proto.Uint64(shardID), NodeID: proto.Uint64(toNodeID)}); err != nil {
+		return err
+	}
+
+	return s.proposeShardOwnerCommand(internal.Command_RemoveShardOwnerCommand, internal.E_RemoveShardOwnerCommand_Command,
+		&internal.RemoveShardOwnerCommand{ID: proto.Uint64(shardID), NodeID: proto.Uint64(fromNodeID)})
+}
+
+// proposeShardOwnerCommand builds a command via buildCommand and proposes
+// it through raft, the same way precreateShardGroups proposes
+// CreateShardGroupCommands.
+func (s *store) proposeShardOwnerCommand(typ internal.Command_Type, desc *proto.ExtensionDesc, value interface{}) error {
+	b, err := proto.Marshal(buildCommand(typ, desc, value))
+	if err != nil {
+		return err
+	}
+	return s.Apply(b)
+}
+
+// Close shuts down the raft subsystem.
+func (s *store) Close() error {
+	select {
+	case <-s.closing:
+		return nil
+	default:
+		close(s.closing)
+	}
+
+	if s.auditLog != nil {
+		s.auditLog.Close()
+	}
+
+	if s.raft != nil {
+		if err := s.raft.Shutdown().Error(); err != nil {
+			return err
+		}
+	}
+	if s.transport != nil {
+		return s.transport.Close()
+	}
+	return nil
+}
+
+// Apply applies a marshaled internal.Command to the raft log, blocking
+// until it has been committed (or the apply fails).
+func (s *store) Apply(b []byte) error {
+	if s.applyFn != nil {
+		return s.applyFn(b)
+	}
+
+	f := s.raft.Apply(b, 10*time.Second)
+	if err := f.Error(); err != nil {
+		return err
+	}
+	if err, ok := f.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// IsLeader reports whether this node is currently the raft leader.
+func (s *store) IsLeader() bool {
+	if s.applyFn != nil {
+		// Driven directly against a storeFSM in tests (see applyFn):
+		// there's no raft cluster to ask, and the whole point of the
+		// seam is to act as the (only) leader.
+		return true
+	}
+	if s.raft == nil {
+		return false
+	}
+	return s.raft.State() == raft.Leader
+}
+
+// Leader returns the address of the current raft leader, if known.
+func (s *store) Leader() string {
+	if s.raft == nil {
+		return ""
+	}
+	return string(s.raft.Leader())
+}
+
+// leave removes node from the raft configuration, e.g. when a meta node is
+// deleted from the cluster via applyDeleteMetaNodeCommand.
+func (s *store) leave(node *NodeInfo) error {
+	if s.raft == nil {
+		return raft.ErrNotLeader
+	}
+	if !s.IsLeader() {
+		return raft.ErrNotLeader
+	}
+	return s.raft.RemoveServer(raft.ServerID(node.TCPHost), 0, 0).Error()
+}
+
+// raftStreamLayer adapts a net.Listener registered on a tcp.Mux into the
+// raft.StreamLayer interface hashicorp/raft's NetworkTransport expects.
+type raftStreamLayer struct {
+	ln   net.Listener
+	addr string
+}
+
+func (l *raftStreamLayer) Accept() (net.Conn, error) { return l.ln.Accept() }
+func (l *raftStreamLayer) Close() error              { return l.ln.Close() }
+func (l *raftStreamLayer) Addr() net.Addr            { return l.ln.Addr() }
+
+func (l *raftStreamLayer) Dial(addr raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	d := &tcp.Dialer{Header: tcp.MuxRaftHeader, Timeout: timeout}
+	return d.Dial(string(addr))
+}
@@ -3,95 +3,210 @@ package meta
 import (
 	"fmt"
 	"io"
-	"io/ioutil"
+	"strings"
 	"time"
 
 	"github.com/gogo/protobuf/proto"
 	"github.com/hashicorp/raft"
+	"github.com/influxdata/influxdb"
 	"github.com/influxdata/influxdb/influxql"
 	"github.com/influxdata/influxdb/services/meta"
-	"github.com/zhexuany/influxcloud/meta/internal"
+	"github.com/zhexuany/influxdb-cluster/meta/internal"
 )
 
 // storeFSM represents the finite state machine used by Store to interact with Raft.
 type storeFSM store
 
-func (fsm *storeFSM) Apply(l *raft.Log) interface{} {
+// fsmDispatch maps every command type to the storeFSM method that
+// applies it. It replaces the old switch in Apply, modeled on the
+// dispatch table Consul's FSM uses: adding a command means adding one
+// entry here instead of threading a new case through Apply by hand.
+var fsmDispatch = map[internal.Command_Type]func(*storeFSM, *internal.Command) interface{}{
+	internal.Command_BatchCommand:                     (*storeFSM).applyBatchCommand,
+	internal.Command_CreateDatabaseCommand:            (*storeFSM).applyCreateDatabaseCommand,
+	internal.Command_DropDatabaseCommand:              (*storeFSM).applyDropDatabaseCommand,
+	internal.Command_CreateRetentionPolicyCommand:     (*storeFSM).applyCreateRetentionPolicyCommand,
+	internal.Command_DropRetentionPolicyCommand:       (*storeFSM).applyDropRetentionPolicyCommand,
+	internal.Command_SetDefaultRetentionPolicyCommand: (*storeFSM).applySetDefaultRetentionPolicyCommand,
+	internal.Command_UpdateRetentionPolicyCommand:     (*storeFSM).applyUpdateRetentionPolicyCommand,
+	internal.Command_CreateShardGroupCommand:          (*storeFSM).applyCreateShardGroupCommand,
+	internal.Command_DeleteShardGroupCommand:          (*storeFSM).applyDeleteShardGroupCommand,
+	internal.Command_CreateContinuousQueryCommand:     (*storeFSM).applyCreateContinuousQueryCommand,
+	internal.Command_DropContinuousQueryCommand:       (*storeFSM).applyDropContinuousQueryCommand,
+	internal.Command_CreateSubscriptionCommand:        (*storeFSM).applyCreateSubscriptionCommand,
+	internal.Command_DropSubscriptionCommand:          (*storeFSM).applyDropSubscriptionCommand,
+	internal.Command_CreateUserCommand:                (*storeFSM).applyCreateUserCommand,
+	internal.Command_DropUserCommand:                  (*storeFSM).applyDropUserCommand,
+	internal.Command_UpdateUserCommand:                (*storeFSM).applyUpdateUserCommand,
+	internal.Command_SetPrivilegeCommand:              (*storeFSM).applySetPrivilegeCommand,
+	internal.Command_SetAdminPrivilegeCommand:         (*storeFSM).applySetAdminPrivilegeCommand,
+	internal.Command_SetDataCommand:                   (*storeFSM).applySetDataCommand,
+	internal.Command_ImportDataCommand:                (*storeFSM).applyImportDataCommand,
+	internal.Command_CreateMetaNodeCommand:            (*storeFSM).applyCreateMetaNodeCommand,
+	internal.Command_DeleteMetaNodeCommand: func(fsm *storeFSM, cmd *internal.Command) interface{} {
+		return fsm.applyDeleteMetaNodeCommand(cmd, (*store)(fsm))
+	},
+	internal.Command_SetMetaNodeCommand:              (*storeFSM).applySetMetaNodeCommand,
+	internal.Command_CreateDataNodeCommand:           (*storeFSM).applyCreateDataNodeCommand,
+	internal.Command_DeleteDataNodeCommand:           (*storeFSM).applyDeleteDataNodeCommand,
+	internal.Command_AddShardOwnerCommand:            (*storeFSM).applyAddShardOwnerCommand,
+	internal.Command_RemoveShardOwnerCommand:         (*storeFSM).applyRemoveShardOwnerCommand,
+	internal.Command_AddPendingShardOwnerCommand:     (*storeFSM).applyAddPendingShardOwnerCommand,
+	internal.Command_RemovePendingShardOwnerCommand:  (*storeFSM).applyRemovePendingShardOwnerCommand,
+	internal.Command_CommitPendingShardOwnerCommand:  (*storeFSM).applyCommitPendingShardOwnerCommand,
+	internal.Command_CreateBalancedShardGroupCommand: (*storeFSM).applyCreateBalancedShardGroupCommand,
+	internal.Command_TruncateShardGroupsCommand:      (*storeFSM).applyTruncateShardGroupsCommand,
+	internal.Command_CreateRoleCommand:               (*storeFSM).applyCreateRoleCommand,
+	internal.Command_DropRoleCommand:                 (*storeFSM).applyDropRoleCommand,
+	internal.Command_ChangeRoleNameCommand:           (*storeFSM).applyChangeRoleNameCommand,
+	internal.Command_AddRoleUsersCommand:             (*storeFSM).applyAddRoleUsersCommand,
+	internal.Command_RemoveRoleUsersCommand:          (*storeFSM).applyRemoveRoleUsersCommand,
+	internal.Command_SetRolePrivilegeCommand:         (*storeFSM).applySetRolePrivilegeCommand,
+	internal.Command_SetRoleAdminPrivilegeCommand:    (*storeFSM).applySetRoleAdminPrivilegeCommand,
+}
+
+// commandMetricName turns typ's generated enum name (e.g.
+// "CreateShardGroupCommand") into the short label its Apply metrics are
+// keyed on (e.g. "CreateShardGroup").
+func commandMetricName(typ internal.Command_Type) string {
+	if name := typ.String(); name != "" {
+		return strings.TrimSuffix(name, "Command")
+	}
+	return "Unknown"
+}
+
+// unwrapLogEntry decodes one raft log entry into the internal.Command
+// Apply should dispatch. With no TrustedKeys configured it's the
+// original behavior: data is unmarshaled as a plain Command, panicking
+// on malformed input exactly as before signing existed. With
+// TrustedKeys configured, data is instead expected to be a
+// SignedCommand: its signature is verified, its nonce checked against
+// fsm.data's replay window and recorded (by cloning fsm.data, the same
+// way every apply*Command method starts, so the clone's nonce carries
+// forward into the *Data the matched apply method itself clones from),
+// and the enclosed Command and envelope are returned for Apply to
+// dispatch and audit. Must be called with s.mu held.
+func (fsm *storeFSM) unwrapLogEntry(data []byte) (*internal.Command, *internal.SignedCommand, error) {
+	s := (*store)(fsm)
+
+	if len(s.config.TrustedKeys) == 0 {
+		var cmd internal.Command
+		if err := proto.Unmarshal(data, &cmd); err != nil {
+			panic(fmt.Errorf("cannot marshal command: %x", data))
+		}
+		return &cmd, nil, nil
+	}
+
+	payload, signed, err := verifySignedCommand(data, s.config.TrustedKeys)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fsm.data.seenNonce(signed.GetNonce()) {
+		return nil, nil, ErrNonceReplayed
+	}
+
 	var cmd internal.Command
-	if err := proto.Unmarshal(l.Data, &cmd); err != nil {
-		panic(fmt.Errorf("cannot marshal command: %x", l.Data))
+	if err := proto.Unmarshal(payload, &cmd); err != nil {
+		panic(fmt.Errorf("cannot marshal command: %x", payload))
 	}
 
+	other := fsm.data.Clone()
+	other.rememberNonce(signed.GetNonce())
+	fsm.data = other
+
+	return &cmd, signed, nil
+}
+
+func (fsm *storeFSM) Apply(l *raft.Log) interface{} {
 	// Lock the store.
 	s := (*store)(fsm)
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	err := func() interface{} {
-		switch cmd.GetType() {
-		case internal.Command_CreateDatabaseCommand:
-			return fsm.applyCreateDatabaseCommand(&cmd)
-		case internal.Command_DropDatabaseCommand:
-			return fsm.applyDropDatabaseCommand(&cmd)
-		case internal.Command_CreateRetentionPolicyCommand:
-			return fsm.applyCreateRetentionPolicyCommand(&cmd)
-		case internal.Command_DropRetentionPolicyCommand:
-			return fsm.applyDropRetentionPolicyCommand(&cmd)
-		case internal.Command_SetDefaultRetentionPolicyCommand:
-			return fsm.applySetDefaultRetentionPolicyCommand(&cmd)
-		case internal.Command_UpdateRetentionPolicyCommand:
-			return fsm.applyUpdateRetentionPolicyCommand(&cmd)
-		case internal.Command_CreateShardGroupCommand:
-			return fsm.applyCreateShardGroupCommand(&cmd)
-		case internal.Command_DeleteShardGroupCommand:
-			return fsm.applyDeleteShardGroupCommand(&cmd)
-		case internal.Command_CreateContinuousQueryCommand:
-			return fsm.applyCreateContinuousQueryCommand(&cmd)
-		case internal.Command_DropContinuousQueryCommand:
-			return fsm.applyDropContinuousQueryCommand(&cmd)
-		case internal.Command_CreateSubscriptionCommand:
-			return fsm.applyCreateSubscriptionCommand(&cmd)
-		case internal.Command_DropSubscriptionCommand:
-			return fsm.applyDropSubscriptionCommand(&cmd)
-		case internal.Command_CreateUserCommand:
-			return fsm.applyCreateUserCommand(&cmd)
-		case internal.Command_DropUserCommand:
-			return fsm.applyDropUserCommand(&cmd)
-		case internal.Command_UpdateUserCommand:
-			return fsm.applyUpdateUserCommand(&cmd)
-		case internal.Command_SetPrivilegeCommand:
-			return fsm.applySetPrivilegeCommand(&cmd)
-		case internal.Command_SetAdminPrivilegeCommand:
-			return fsm.applySetAdminPrivilegeCommand(&cmd)
-		case internal.Command_SetDataCommand:
-			return fsm.applySetDataCommand(&cmd)
-		case internal.Command_CreateMetaNodeCommand:
-			return fsm.applyCreateMetaNodeCommand(&cmd)
-		case internal.Command_DeleteMetaNodeCommand:
-			return fsm.applyDeleteMetaNodeCommand(&cmd, s)
-		case internal.Command_SetMetaNodeCommand:
-			return fsm.applySetMetaNodeCommand(&cmd)
-		case internal.Command_CreateDataNodeCommand:
-			return fsm.applyCreateDataNodeCommand(&cmd)
-		case internal.Command_DeleteDataNodeCommand:
-			return fsm.applyDeleteDataNodeCommand(&cmd)
-		case internal.Command_AddShardOwnerCommand:
-			// return fsm.applyAddShardOwnerCommand(&cmd)
-		default:
+	cmd, signed, err := fsm.unwrapLogEntry(l.Data)
+	if err != nil {
+		return err
+	}
+
+	name := commandMetricName(cmd.GetType())
+	s.metrics.AddSample([]string{"meta", "fsm", "apply", "command_size"}, float32(len(l.Data)))
+	defer s.metrics.MeasureSince([]string{"meta", "fsm", "apply", name}, time.Now())
+
+	result := func() interface{} {
+		apply, ok := fsmDispatch[cmd.GetType()]
+		if !ok {
 			panic(fmt.Errorf("cannot apply command: %x", l.Data))
 		}
-		return nil
+		return apply(fsm, cmd)
 	}()
 
+	if result != nil {
+		s.metrics.IncrCounter([]string{"meta", "fsm", "apply", "error"}, 1)
+	} else if signed != nil {
+		s.appendAuditEntry(AuditEntry{
+			Issuer:    signed.GetIssuer(),
+			KeyID:     signed.GetKeyId(),
+			Command:   name,
+			Index:     l.Index,
+			Term:      l.Term,
+			IssuedAt:  time.Unix(0, signed.GetIssuedAt()),
+			AppliedAt: time.Now(),
+		})
+	}
+
 	// Copy term and index to new metadata.
 	fsm.data.Data.Term = l.Term
 	fsm.data.Data.Index = l.Index
+	s.metrics.SetGauge([]string{"meta", "fsm", "index"}, float32(l.Index))
+	s.metrics.SetGauge([]string{"meta", "fsm", "term"}, float32(l.Term))
 
 	// signal that the data changed
 	close(s.dataChanged)
 	s.dataChanged = make(chan struct{})
 
-	return err
+	return result
+}
+
+// applyBatchCommand applies every command in cmd's BatchCommand against
+// a scratch storeFSM cloned from fsm.data, the same way Apply dispatches
+// a single command, stopping at the first error. The scratch data is
+// only swapped into fsm.data once every sub-command has succeeded, so a
+// batch that fails partway through never leaves an earlier sub-command's
+// mutation applied to fsm.data despite the batch as a whole returning an
+// error. See Batch.Commit.
+func (fsm *storeFSM) applyBatchCommand(cmd *internal.Command) interface{} {
+	ext, _ := proto.GetExtension(cmd, internal.E_BatchCommand_Command)
+	v := ext.(*internal.BatchCommand)
+
+	scratch := &store{
+		path:        fsm.path,
+		addr:        fsm.addr,
+		data:        fsm.data.Clone(),
+		dataChanged: fsm.dataChanged,
+		config:      fsm.config,
+		raft:        fsm.raft,
+		transport:   fsm.transport,
+		peerLn:      fsm.peerLn,
+		closing:     fsm.closing,
+		applyFn:     fsm.applyFn,
+		CopyShard:   fsm.CopyShard,
+		metrics:     fsm.metrics,
+		auditLog:    fsm.auditLog,
+		auditRing:   fsm.auditRing,
+	}
+
+	for _, sub := range v.GetCommands() {
+		apply, ok := fsmDispatch[sub.GetType()]
+		if !ok {
+			panic(fmt.Errorf("cannot apply command: %x", sub))
+		}
+		if result := apply((*storeFSM)(scratch), sub); result != nil {
+			return result
+		}
+	}
+
+	fsm.data = scratch.data
+	return nil
 }
 
 func (fsm *storeFSM) applyUpdateDataNodeCommand(cmd *internal.Command) interface{} {
@@ -306,7 +421,7 @@ func (fsm *storeFSM) applyCreateSubscriptionCommand(cmd *internal.Command) inter
 
 	// Copy data and update.
 	other := fsm.data.Clone()
-	if err := other.Data.CreateSubscription(v.GetDatabase(), v.GetRetentionPolicy(), v.GetName(), v.GetMode(), v.GetDestinations()); err != nil {
+	if err := other.CreateSubscription(v.GetDatabase(), v.GetRetentionPolicy(), v.GetName(), v.GetMode(), v.GetDestinations()); err != nil {
 		return err
 	}
 	fsm.data = other
@@ -320,7 +435,7 @@ func (fsm *storeFSM) applyDropSubscriptionCommand(cmd *internal.Command) interfa
 
 	// Copy data and update.
 	other := fsm.data.Clone()
-	if err := other.Data.DropSubscription(v.GetDatabase(), v.GetRetentionPolicy(), v.GetName()); err != nil {
+	if err := other.DropSubscription(v.GetDatabase(), v.GetRetentionPolicy(), v.GetName()); err != nil {
 		return err
 	}
 	fsm.data = other
@@ -404,6 +519,24 @@ func (fsm *storeFSM) applySetDataCommand(cmd *internal.Command) interface{} {
 	return nil
 }
 
+func (fsm *storeFSM) applyImportDataCommand(cmd *internal.Command) interface{} {
+	ext, _ := proto.GetExtension(cmd, internal.E_ImportDataCommand_Command)
+	v := ext.(*internal.ImportDataCommand)
+
+	opts := ImportOptions{
+		Merge:       v.GetMerge(),
+		MergePolicy: MergePolicy(v.GetMergePolicy()),
+		Force:       v.GetForce(),
+	}
+
+	other := fsm.data.Clone()
+	if _, err := other.Import(v.GetData(), opts); err != nil {
+		return err
+	}
+	fsm.data = other
+	return nil
+}
+
 func (fsm *storeFSM) applyCreateMetaNodeCommand(cmd *internal.Command) interface{} {
 	ext, _ := proto.GetExtension(cmd, internal.E_CreateMetaNodeCommand_Command)
 	v := ext.(*internal.CreateMetaNodeCommand)
@@ -481,6 +614,90 @@ func (fsm *storeFSM) applyDeleteDataNodeCommand(cmd *internal.Command) interface
 	return nil
 }
 
+func (fsm *storeFSM) applyCreateRoleCommand(cmd *internal.Command) interface{} {
+	ext, _ := proto.GetExtension(cmd, internal.E_CreateRoleCommand_Command)
+	v := ext.(*internal.CreateRoleCommand)
+
+	other := fsm.data.Clone()
+	if err := other.CreateRole(v.GetName()); err != nil {
+		return err
+	}
+	fsm.data = other
+	return nil
+}
+
+func (fsm *storeFSM) applyDropRoleCommand(cmd *internal.Command) interface{} {
+	ext, _ := proto.GetExtension(cmd, internal.E_DropRoleCommand_Command)
+	v := ext.(*internal.DropRoleCommand)
+
+	other := fsm.data.Clone()
+	if err := other.DropRole(v.GetName()); err != nil {
+		return err
+	}
+	fsm.data = other
+	return nil
+}
+
+func (fsm *storeFSM) applyChangeRoleNameCommand(cmd *internal.Command) interface{} {
+	ext, _ := proto.GetExtension(cmd, internal.E_ChangeRoleNameCommand_Command)
+	v := ext.(*internal.ChangeRoleNameCommand)
+
+	other := fsm.data.Clone()
+	if err := other.ChangeRoleName(v.GetOldName(), v.GetNewName()); err != nil {
+		return err
+	}
+	fsm.data = other
+	return nil
+}
+
+func (fsm *storeFSM) applyAddRoleUsersCommand(cmd *internal.Command) interface{} {
+	ext, _ := proto.GetExtension(cmd, internal.E_AddRoleUsersCommand_Command)
+	v := ext.(*internal.AddRoleUsersCommand)
+
+	other := fsm.data.Clone()
+	if err := other.AddRoleUsers(v.GetName(), v.GetUsers()); err != nil {
+		return err
+	}
+	fsm.data = other
+	return nil
+}
+
+func (fsm *storeFSM) applyRemoveRoleUsersCommand(cmd *internal.Command) interface{} {
+	ext, _ := proto.GetExtension(cmd, internal.E_RemoveRoleUsersCommand_Command)
+	v := ext.(*internal.RemoveRoleUsersCommand)
+
+	other := fsm.data.Clone()
+	if err := other.RemoveRoleUsers(v.GetName(), v.GetUsers()); err != nil {
+		return err
+	}
+	fsm.data = other
+	return nil
+}
+
+func (fsm *storeFSM) applySetRolePrivilegeCommand(cmd *internal.Command) interface{} {
+	ext, _ := proto.GetExtension(cmd, internal.E_SetRolePrivilegeCommand_Command)
+	v := ext.(*internal.SetRolePrivilegeCommand)
+
+	other := fsm.data.Clone()
+	if err := other.SetRolePrivilege(v.GetName(), v.GetDatabase(), influxql.Privilege(v.GetPrivilege())); err != nil {
+		return err
+	}
+	fsm.data = other
+	return nil
+}
+
+func (fsm *storeFSM) applySetRoleAdminPrivilegeCommand(cmd *internal.Command) interface{} {
+	ext, _ := proto.GetExtension(cmd, internal.E_SetRoleAdminPrivilegeCommand_Command)
+	v := ext.(*internal.SetRoleAdminPrivilegeCommand)
+
+	other := fsm.data.Clone()
+	if err := other.SetRoleAdminPrivilege(v.GetName(), v.GetAdmin()); err != nil {
+		return err
+	}
+	fsm.data = other
+	return nil
+}
+
 //TODO finish these functions
 // func (fsm *storeFSM) applyUpdateDataNode(cmd *internal.Command) (interface{})            {}
 // func (fsm *storeFSM) applyCreateDatabase(cmd *internal.Command) interface{} {}
@@ -524,21 +741,108 @@ func (fsm *storeFSM) applyDeleteDataNodeCommand(cmd *internal.Command) interface
 // func (fsm *storeFSM) applyDeleteMetaNode(cmd *internal.Command) (interface{})            {}
 // func (fsm *storeFSM) applyCreateDataNode(cmd *internal.Command) (interface{})            {}
 // func (fsm *storeFSM) applyDeleteDataNode(cmd *internal.Command) (interface{})            {}
-// func (fsm *storeFSM) applyRemovePendingShardOwner(cmd *internal.Command) (interface{})   {}
-func (fsm *storeFSM) applyAddPendingShardOwner(cmd *internal.Command) interface{} {
-	// ext, err := proto.GetExtension(cmd, internal.E_AddPendingShardOwnerCommand_Command)
-	// if err != nil {
-	// 	return nil
-	// }
-	// v := ext.(*internal.AddPendingShardOwnerCommand)
+func (fsm *storeFSM) applyAddShardOwnerCommand(cmd *internal.Command) interface{} {
+	ext, _ := proto.GetExtension(cmd, internal.E_AddShardOwnerCommand_Command)
+	v := ext.(*internal.AddShardOwnerCommand)
+
+	other := fsm.data.Clone()
+	if err := other.AddShardOwner(v.GetID(), v.GetNodeID()); err != nil {
+		return err
+	}
+	fsm.data = other
+	return nil
+}
+
+func (fsm *storeFSM) applyRemoveShardOwnerCommand(cmd *internal.Command) interface{} {
+	ext, _ := proto.GetExtension(cmd, internal.E_RemoveShardOwnerCommand_Command)
+	v := ext.(*internal.RemoveShardOwnerCommand)
+
+	other := fsm.data.Clone()
+	if err := other.RemoveShardOwner(v.GetID(), v.GetNodeID()); err != nil {
+		return err
+	}
+	fsm.data = other
+	return nil
+}
+
+func (fsm *storeFSM) applyAddPendingShardOwnerCommand(cmd *internal.Command) interface{} {
+	ext, _ := proto.GetExtension(cmd, internal.E_AddPendingShardOwnerCommand_Command)
+	v := ext.(*internal.AddPendingShardOwnerCommand)
+
+	other := fsm.data.Clone()
+	if err := other.AddPendingShardOwner(v.GetID(), v.GetNodeID()); err != nil {
+		return err
+	}
+	fsm.data = other
+	return nil
+}
+
+func (fsm *storeFSM) applyRemovePendingShardOwnerCommand(cmd *internal.Command) interface{} {
+	ext, _ := proto.GetExtension(cmd, internal.E_RemovePendingShardOwnerCommand_Command)
+	v := ext.(*internal.RemovePendingShardOwnerCommand)
 
+	other := fsm.data.Clone()
+	if err := other.RemovePendingShardOwner(v.GetID(), v.GetNodeID()); err != nil {
+		return err
+	}
+	fsm.data = other
+	return nil
+}
+
+func (fsm *storeFSM) applyCommitPendingShardOwnerCommand(cmd *internal.Command) interface{} {
+	ext, _ := proto.GetExtension(cmd, internal.E_CommitPendingShardOwnerCommand_Command)
+	v := ext.(*internal.CommitPendingShardOwnerCommand)
+
+	other := fsm.data.Clone()
+	if err := other.CommitPendingShardOwner(v.GetID(), v.GetNodeID()); err != nil {
+		return err
+	}
+	fsm.data = other
+	return nil
+}
+
+func (fsm *storeFSM) applyCreateBalancedShardGroupCommand(cmd *internal.Command) interface{} {
+	ext, _ := proto.GetExtension(cmd, internal.E_CreateBalancedShardGroupCommand_Command)
+	v := ext.(*internal.CreateBalancedShardGroupCommand)
+
+	other := fsm.data.Clone()
+	if err := other.CreateBalancedShardGroup(v.GetDatabase(), v.GetPolicy(), time.Unix(0, v.GetTimestamp())); err != nil {
+		return err
+	}
+	fsm.data = other
 	return nil
 }
 
-// func (fsm *storeFSM) applyCommitPendingShardOwner(cmd *internal.Command) (interface{})   {}
+func (fsm *storeFSM) applyTruncateShardGroupsCommand(cmd *internal.Command) interface{} {
+	ext, _ := proto.GetExtension(cmd, internal.E_TruncateShardGroupsCommand_Command)
+	v := ext.(*internal.TruncateShardGroupsCommand)
+
+	other := fsm.data.Clone()
+	rpi, err := other.Data.RetentionPolicy(v.GetDatabase(), v.GetPolicy())
+	if err != nil {
+		return err
+	} else if rpi == nil {
+		return influxdb.ErrRetentionPolicyNotFound(v.GetPolicy())
+	}
+
+	t := time.Unix(0, v.GetTimestamp())
+	for i := range rpi.ShardGroups {
+		sg := &rpi.ShardGroups[i]
+		if sg.Deleted() {
+			continue
+		}
+		if err := other.TruncateShardsGrops(sg, t); err != nil {
+			return err
+		}
+	}
+	fsm.data = other
+	return nil
+}
 
 func (fsm *storeFSM) Snapshot() (raft.FSMSnapshot, error) {
 	s := (*store)(fsm)
+	defer s.metrics.MeasureSince([]string{"meta", "fsm", "snapshot"}, time.Now())
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -546,15 +850,11 @@ func (fsm *storeFSM) Snapshot() (raft.FSMSnapshot, error) {
 }
 
 func (fsm *storeFSM) Restore(r io.ReadCloser) error {
-	// Read all bytes.
-	b, err := ioutil.ReadAll(r)
-	if err != nil {
-		return err
-	}
+	defer (*store)(fsm).metrics.MeasureSince([]string{"meta", "fsm", "restore"}, time.Now())
 
-	// Decode metadata.
+	// Decode the streaming, checksummed snapshot written by Persist.
 	data := &Data{}
-	if err := data.UnmarshalBinary(b); err != nil {
+	if err := data.ReadSnapshotFrom(r); err != nil {
 		return err
 	}
 
@@ -572,14 +872,8 @@ type storeFSMSnapshot struct {
 
 func (s *storeFSMSnapshot) Persist(sink raft.SnapshotSink) error {
 	err := func() error {
-		// Encode data.
-		p, err := s.Data.MarshalBinary()
-		if err != nil {
-			return err
-		}
-
-		// Write data to sink.
-		if _, err := sink.Write(p); err != nil {
+		// Write data to sink as a streaming, checksummed snapshot.
+		if err := s.Data.WriteSnapshotTo(sink); err != nil {
 			return err
 		}
 
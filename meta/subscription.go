@@ -0,0 +1,46 @@
+package meta
+
+import (
+	"fmt"
+
+	"github.com/influxdata/influxdb"
+	"github.com/influxdata/influxdb/services/meta"
+)
+
+// CreateSubscription creates a subscription on the given database and
+// retention policy that fans writes out to destinations, in either ALL
+// mode (every destination gets every write) or ANY mode (writes are
+// load-balanced across destinations). Storage is delegated to the
+// embedded *meta.Data's retention policy, the same as upstream; this
+// wrapper only adds the validation upstream's CreateSubscription skips,
+// so a bad mode or an empty destination list is rejected before it's
+// ever replicated to the rest of the cluster.
+func (data *Data) CreateSubscription(database, rp, name, mode string, destinations []string) error {
+	if mode != "ALL" && mode != "ANY" {
+		return fmt.Errorf("invalid subscription mode %q: must be ALL or ANY", mode)
+	}
+	if len(destinations) == 0 {
+		return fmt.Errorf("subscription %q must have at least one destination", name)
+	}
+
+	return data.Data.CreateSubscription(database, rp, name, mode, destinations)
+}
+
+// DropSubscription removes a subscription from the given database and
+// retention policy.
+func (data *Data) DropSubscription(database, rp, name string) error {
+	return data.Data.DropSubscription(database, rp, name)
+}
+
+// Subscriptions returns the subscriptions configured on database's
+// retention policy rp.
+func (data *Data) Subscriptions(database, rp string) ([]meta.SubscriptionInfo, error) {
+	rpi, err := data.Data.RetentionPolicy(database, rp)
+	if err != nil {
+		return nil, err
+	} else if rpi == nil {
+		return nil, influxdb.ErrRetentionPolicyNotFound(rp)
+	}
+
+	return rpi.Subscriptions, nil
+}
@@ -0,0 +1,241 @@
+package meta
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/zhexuany/influxdb-cluster/meta/internal"
+)
+
+// walFile is the name of the client's command WAL, relative to
+// Client.Path(). It durably records every command submitted via
+// retryUntilExec so writes like CreateShardGroup, CreateContinuousQuery,
+// CreateSubscription and JoinMetaServer survive a client restart or a
+// meta cluster outage instead of being dropped on the floor.
+const walFile = "meta.wal"
+
+// walRecord is a single WAL entry: a monotonically increasing request
+// number and the command submitted for it. Uncommitted records are
+// replayed in requestNum order on startup (see Client.replayPending).
+type walRecord struct {
+	requestNum uint64
+	cmd        *internal.Command
+}
+
+// commandWAL is an append-only, on-disk log of in-flight commands. A
+// commandWAL with no backing file (path == "") behaves as a purely
+// in-memory, best-effort request-number generator, matching the
+// behavior of a Client configured without a state directory.
+type commandWAL struct {
+	mu sync.Mutex
+
+	f *os.File
+
+	nextRequestNum uint64
+	pending        []*walRecord
+}
+
+// openCommandWAL opens (creating if necessary) the WAL file under dir and
+// replays any records left on disk by a previous process into memory so
+// they can be recovered via Client.RecoverPending or resubmitted by
+// Client.replayPending.
+func openCommandWAL(dir string) (*commandWAL, error) {
+	w := &commandWAL{nextRequestNum: 1}
+	if dir == "" {
+		return w, nil
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, walFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	w.f = f
+
+	if err := w.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// load reads every record currently on disk into w.pending and advances
+// nextRequestNum past the highest one seen.
+func (w *commandWAL) load() error {
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(w.f)
+	for {
+		rec, err := readWALRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if rec.requestNum >= w.nextRequestNum {
+			w.nextRequestNum = rec.requestNum + 1
+		}
+		w.pending = append(w.pending, rec)
+	}
+
+	_, err := w.f.Seek(0, io.SeekEnd)
+	return err
+}
+
+// append durably records cmd and returns the request number assigned to
+// it. The record stays in the WAL until a matching markCommitted call.
+func (w *commandWAL) append(cmd *internal.Command) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	reqNum := w.nextRequestNum
+	w.nextRequestNum++
+	w.pending = append(w.pending, &walRecord{requestNum: reqNum, cmd: cmd})
+
+	if w.f == nil {
+		return reqNum, nil
+	}
+
+	if err := writeWALRecord(w.f, reqNum, cmd); err != nil {
+		return reqNum, err
+	}
+	return reqNum, w.f.Sync()
+}
+
+// markCommitted drops reqNum from the pending set and compacts the WAL
+// file so it only ever holds commands still awaiting a raft index.
+func (w *commandWAL) markCommitted(reqNum uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for i, rec := range w.pending {
+		if rec.requestNum == reqNum {
+			w.pending = append(w.pending[:i], w.pending[i+1:]...)
+			break
+		}
+	}
+
+	return w.compact()
+}
+
+// compact rewrites the WAL file to hold exactly w.pending, reclaiming the
+// space used by already-committed records.
+func (w *commandWAL) compact() error {
+	if w.f == nil {
+		return nil
+	}
+
+	if err := w.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	for _, rec := range w.pending {
+		if err := writeWALRecord(w.f, rec.requestNum, rec.cmd); err != nil {
+			return err
+		}
+	}
+	return w.f.Sync()
+}
+
+// pendingRecords returns a snapshot of the still-uncommitted records, in
+// requestNum order.
+func (w *commandWAL) pendingRecords() []*walRecord {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	recs := make([]*walRecord, len(w.pending))
+	copy(recs, w.pending)
+	return recs
+}
+
+func writeWALRecord(w io.Writer, reqNum uint64, cmd *internal.Command) error {
+	b, err := proto.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+
+	var hdr [16]byte
+	binary.BigEndian.PutUint64(hdr[0:8], reqNum)
+	binary.BigEndian.PutUint64(hdr[8:16], uint64(len(b)))
+
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func readWALRecord(r io.Reader) (*walRecord, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	reqNum := binary.BigEndian.Uint64(hdr[0:8])
+	n := binary.BigEndian.Uint64(hdr[8:16])
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+
+	cmd := &internal.Command{}
+	if err := proto.Unmarshal(b, cmd); err != nil {
+		return nil, err
+	}
+
+	return &walRecord{requestNum: reqNum, cmd: cmd}, nil
+}
+
+// RecoverPending yields every command recorded in the client's WAL that
+// hasn't been confirmed committed, in request-number order, so operators
+// can inspect writes left stuck in flight by a crash or a meta cluster
+// outage without having to replay them.
+func (c *Client) RecoverPending(yield func(cmd *internal.Command) error) error {
+	c.mu.RLock()
+	wal := c.wal
+	c.mu.RUnlock()
+
+	if wal == nil {
+		return nil
+	}
+
+	for _, rec := range wal.pendingRecords() {
+		if err := yield(rec.cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replayPending resubmits every command left in the WAL by a previous
+// process, in request-number order, before Open returns. This is what
+// makes a restart-during-retry safe: the command is retried exactly as
+// retryUntilExec would have, against whichever server is currently the
+// leader, and is marked committed once it succeeds.
+func (c *Client) replayPending() error {
+	c.mu.RLock()
+	wal := c.wal
+	c.mu.RUnlock()
+
+	if wal == nil {
+		return nil
+	}
+
+	for _, rec := range wal.pendingRecords() {
+		if err := c.submitCommand(rec.cmd, rec.requestNum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
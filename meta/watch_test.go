@@ -0,0 +1,126 @@
+package meta
+
+import (
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/services/meta"
+)
+
+func eventByPath(events []WatchEvent, path string) *WatchEvent {
+	for i := range events {
+		if events[i].Path == path {
+			return &events[i]
+		}
+	}
+	return nil
+}
+
+func TestDiffWatchEvents_CreateAndUpdate(t *testing.T) {
+	prev := &Data{Data: &meta.Data{
+		Databases: []meta.DatabaseInfo{{Name: "db0"}},
+		Users:     []meta.UserInfo{{Name: "alice"}},
+	}}
+	cur := &Data{Data: &meta.Data{
+		Databases: []meta.DatabaseInfo{
+			{Name: "db0", DefaultRetentionPolicy: "autogen"},
+			{Name: "db1"},
+		},
+		Users: []meta.UserInfo{{Name: "alice"}},
+	}}
+
+	events := diffWatchEvents(42, prev, cur)
+
+	if ev := eventByPath(events, "databases/db0"); ev == nil || ev.Op != WatchUpdate || ev.Index != 42 {
+		t.Fatalf("databases/db0 = %+v, want an update at index 42", ev)
+	}
+	if ev := eventByPath(events, "databases/db1"); ev == nil || ev.Op != WatchCreate {
+		t.Fatalf("databases/db1 = %+v, want a create", ev)
+	}
+	if ev := eventByPath(events, "users/bob"); ev != nil {
+		t.Fatalf("unexpected event for a user that was never added: %+v", ev)
+	}
+
+	// alice is unchanged, so no event should be emitted for her.
+	if ev := eventByPath(events, "users/alice"); ev != nil {
+		t.Fatalf("unexpected event for an unchanged user: %+v", ev)
+	}
+}
+
+func TestDiffWatchEvents_Deletes(t *testing.T) {
+	prev := &Data{Data: &meta.Data{
+		Databases: []meta.DatabaseInfo{{Name: "db0"}, {Name: "db1"}},
+	}}
+	cur := &Data{Data: &meta.Data{
+		Databases: []meta.DatabaseInfo{{Name: "db0"}},
+	}}
+
+	events := diffWatchEvents(1, prev, cur)
+
+	ev := eventByPath(events, "databases/db1")
+	if ev == nil || ev.Op != WatchDelete {
+		t.Fatalf("databases/db1 = %+v, want a delete", ev)
+	}
+	if ev.Payload != nil {
+		t.Fatalf("delete event Payload = %v, want nil", ev.Payload)
+	}
+}
+
+func TestDiffWatchEvents_MetaAndDataNodes(t *testing.T) {
+	prev := &Data{
+		Data:      &meta.Data{},
+		MetaNodes: NodeInfos{{ID: 1, Host: "m1:8091"}},
+		DataNodes: NodeInfos{{ID: 1, Host: "d1:8088"}},
+	}
+	cur := &Data{
+		Data:      &meta.Data{},
+		MetaNodes: NodeInfos{{ID: 1, Host: "m1:8091"}, {ID: 2, Host: "m2:8091"}},
+		DataNodes: NodeInfos{},
+	}
+
+	events := diffWatchEvents(7, prev, cur)
+
+	if ev := eventByPath(events, "meta-nodes/2"); ev == nil || ev.Op != WatchCreate {
+		t.Fatalf("meta-nodes/2 = %+v, want a create", ev)
+	}
+	if ev := eventByPath(events, "data-nodes/1"); ev == nil || ev.Op != WatchDelete {
+		t.Fatalf("data-nodes/1 = %+v, want a delete", ev)
+	}
+}
+
+func TestDiffWatchEvents_ShardGroups(t *testing.T) {
+	rpUnchanged := meta.RetentionPolicyInfo{
+		Name: "autogen",
+		ShardGroups: []meta.ShardGroupInfo{
+			{ID: 1, EndTime: time.Unix(0, 0)},
+			{ID: 2, EndTime: time.Unix(0, 0)},
+		},
+	}
+	prev := &Data{Data: &meta.Data{
+		Databases: []meta.DatabaseInfo{{Name: "db0", RetentionPolicies: []meta.RetentionPolicyInfo{rpUnchanged}}},
+	}}
+
+	rpChanged := meta.RetentionPolicyInfo{
+		Name: "autogen",
+		ShardGroups: []meta.ShardGroupInfo{
+			{ID: 1, EndTime: time.Unix(0, 0)},                               // unchanged
+			{ID: 2, EndTime: time.Unix(0, 0), DeletedAt: time.Unix(100, 0)}, // deleted
+			{ID: 3, EndTime: time.Unix(0, 0)},                               // created
+		},
+	}
+	cur := &Data{Data: &meta.Data{
+		Databases: []meta.DatabaseInfo{{Name: "db0", RetentionPolicies: []meta.RetentionPolicyInfo{rpChanged}}},
+	}}
+
+	events := diffWatchEvents(9, prev, cur)
+
+	if ev := eventByPath(events, "shard-groups/db0/autogen/1"); ev != nil {
+		t.Fatalf("unexpected event for an unchanged shard group: %+v", ev)
+	}
+	if ev := eventByPath(events, "shard-groups/db0/autogen/2"); ev == nil || ev.Op != WatchDelete {
+		t.Fatalf("shard-groups/db0/autogen/2 = %+v, want a delete", ev)
+	}
+	if ev := eventByPath(events, "shard-groups/db0/autogen/3"); ev == nil || ev.Op != WatchCreate {
+		t.Fatalf("shard-groups/db0/autogen/3 = %+v, want a create", ev)
+	}
+}
@@ -0,0 +1,52 @@
+package tcp
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// Dialer dials a remote mux-protected address, writing the registered
+// header byte immediately after the connection is established so the
+// remote Mux routes the connection to the right Listener.
+type Dialer struct {
+	// Header is the byte written to the connection right after dialing.
+	Header byte
+
+	// Timeout is the dial timeout passed to net.DialTimeout.
+	Timeout time.Duration
+
+	// TLSConfig, when non-nil, is used to wrap the dialed connection in
+	// a TLS client handshake once the header byte has been written in
+	// the clear.
+	TLSConfig *tls.Config
+}
+
+// Dial connects to addr, writes the mux header byte, and returns the
+// resulting connection.
+func (d *Dialer) Dial(addr string) (net.Conn, error) {
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write([]byte{d.Header}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if d.TLSConfig != nil {
+		conn = tls.Client(conn, d.TLSConfig)
+	}
+
+	return conn, nil
+}
+
+// DefaultDialTimeout is the default timeout used by Dialer.Dial when
+// Dialer.Timeout is unset.
+const DefaultDialTimeout = 30 * time.Second
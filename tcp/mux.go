@@ -0,0 +1,152 @@
+package tcp
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Header byte values used to demux connections accepted on a single port.
+// Each client writes one of these bytes as the first byte on the wire
+// immediately after connecting so the Mux knows which registered Listener
+// should receive the connection.
+const (
+	// MuxRaftHeader is the header byte used for internal raft traffic.
+	MuxRaftHeader byte = 0
+
+	// MuxExecHeader is the header byte used for meta command execution
+	// requests sent by Client.retryUntilExec.
+	MuxExecHeader byte = 1
+
+	// MuxRPCHeader is the header byte used for general purpose RPC calls
+	// between meta nodes (e.g. snapshot transfer, join requests).
+	MuxRPCHeader byte = 5
+)
+
+// muxHeaderTimeout is how long a Mux will wait for a client to write its
+// header byte before giving up on the connection.
+const muxHeaderTimeout = 30 * time.Second
+
+// Mux multiplexes a single net.Listener so that multiple protocols can share
+// one bind address. Callers register a header byte with Listen and receive a
+// net.Listener whose Accept only returns connections tagged with that byte.
+type Mux struct {
+	mu        sync.Mutex
+	ln        net.Listener
+	m         map[byte]*muxListener
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// Timeout is the maximum amount of time to wait for the header byte.
+	Timeout time.Duration
+
+	Logger *log.Logger
+}
+
+// NewMux returns a new Mux that multiplexes connections accepted by ln.
+func NewMux(ln net.Listener) *Mux {
+	return &Mux{
+		ln:      ln,
+		m:       make(map[byte]*muxListener),
+		closed:  make(chan struct{}),
+		Timeout: muxHeaderTimeout,
+		Logger:  log.New(os.Stderr, "[tcp-mux] ", log.LstdFlags),
+	}
+}
+
+// Serve handles connections from ln and demuxes them based on the first
+// byte written by the client. Serve blocks until the underlying listener
+// is closed.
+func (mux *Mux) Serve() error {
+	for {
+		conn, err := mux.ln.Accept()
+		if err != nil {
+			select {
+			case <-mux.closed:
+				return nil
+			default:
+				return err
+			}
+		}
+		go mux.handleConn(conn)
+	}
+}
+
+func (mux *Mux) handleConn(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(mux.Timeout))
+
+	var hdr [1]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		mux.Logger.Printf("tcp.Mux: failed to read header byte: %s", err)
+		conn.Close()
+		return
+	}
+
+	conn.SetReadDeadline(time.Time{})
+
+	mux.mu.Lock()
+	ln, ok := mux.m[hdr[0]]
+	mux.mu.Unlock()
+	if !ok {
+		mux.Logger.Printf("tcp.Mux: unregistered header byte: %x", hdr[0])
+		conn.Close()
+		return
+	}
+
+	select {
+	case ln.c <- conn:
+	case <-mux.closed:
+		conn.Close()
+	}
+}
+
+// Listen registers a header byte with the mux and returns a net.Listener
+// that receives any connection tagged with that byte. It panics if the
+// header byte is already registered, which indicates a programming error.
+func (mux *Mux) Listen(header byte) net.Listener {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	if _, ok := mux.m[header]; ok {
+		panic(fmt.Sprintf("tcp.Mux: header byte already registered: %x", header))
+	}
+
+	ln := &muxListener{
+		mux:    mux,
+		header: header,
+		c:      make(chan net.Conn),
+	}
+	mux.m[header] = ln
+	return ln
+}
+
+// Close closes the underlying listener.
+func (mux *Mux) Close() error {
+	mux.closeOnce.Do(func() { close(mux.closed) })
+	return mux.ln.Close()
+}
+
+// muxListener is a net.Listener implementation that receives connections
+// forwarded by a Mux for a single header byte.
+type muxListener struct {
+	mux    *Mux
+	header byte
+	c      chan net.Conn
+}
+
+func (ln *muxListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.c:
+		return conn, nil
+	case <-ln.mux.closed:
+		return nil, fmt.Errorf("tcp.Mux: listener for header %x closed", ln.header)
+	}
+}
+
+func (ln *muxListener) Close() error { return nil }
+
+func (ln *muxListener) Addr() net.Addr { return ln.mux.ln.Addr() }
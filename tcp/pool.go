@@ -0,0 +1,128 @@
+package tcp
+
+import (
+	"net"
+	"sync"
+)
+
+const (
+	// DefaultPoolInitialSize is the number of connections eagerly opened
+	// to a remote address whenever it is requested with no idle
+	// connection pooled for it.
+	DefaultPoolInitialSize = 4
+
+	// DefaultPoolMaxSize is the maximum number of pooled connections kept
+	// open to any single remote address.
+	DefaultPoolMaxSize = 64
+)
+
+// Pool is a bounded set of pooled connections, keyed by remote address,
+// dialed through a Dialer. It is safe for concurrent use.
+type Pool struct {
+	mu   sync.Mutex
+	pool map[string][]net.Conn
+
+	// Dialer is used to establish new connections when the pool for an
+	// address is empty.
+	Dialer *Dialer
+
+	// InitialSize is how many connections to open whenever an address is
+	// requested from the pool while no idle connection for it is pooled.
+	InitialSize int
+
+	// MaxSize is the maximum number of idle connections retained per
+	// address; connections returned beyond this are closed instead.
+	MaxSize int
+}
+
+// NewPool returns a new Pool that dials connections with d.
+func NewPool(d *Dialer) *Pool {
+	return &Pool{
+		pool:        make(map[string][]net.Conn),
+		Dialer:      d,
+		InitialSize: DefaultPoolInitialSize,
+		MaxSize:     DefaultPoolMaxSize,
+	}
+}
+
+// Conn returns a pooled connection to addr, dialing one (and priming the
+// pool with InitialSize connections) if none are idle.
+func (p *Pool) Conn(addr string) (net.Conn, error) {
+	p.mu.Lock()
+	conns := p.pool[addr]
+	if len(conns) > 0 {
+		conn := conns[len(conns)-1]
+		p.pool[addr] = conns[:len(conns)-1]
+		p.mu.Unlock()
+		return conn, nil
+	}
+	p.mu.Unlock()
+
+	conn, err := p.Dialer.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Prime the pool in the background so subsequent callers don't pay
+	// the dial cost one connection at a time.
+	go p.prime(addr)
+
+	return conn, nil
+}
+
+func (p *Pool) prime(addr string) {
+	for i := 0; i < p.initialSize()-1; i++ {
+		conn, err := p.Dialer.Dial(addr)
+		if err != nil {
+			return
+		}
+		p.Release(addr, conn)
+	}
+}
+
+// Release returns conn to the pool for addr. If the pool for addr is
+// already at MaxSize, conn is closed instead.
+func (p *Pool) Release(addr string, conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.pool[addr]) >= p.maxSize() {
+		conn.Close()
+		return
+	}
+	p.pool[addr] = append(p.pool[addr], conn)
+}
+
+// Discard closes conn without returning it to the pool. It should be used
+// instead of Release whenever a pooled connection errors out.
+func (p *Pool) Discard(conn net.Conn) {
+	conn.Close()
+}
+
+// Close closes every idle connection in the pool.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for addr, conns := range p.pool {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		delete(p.pool, addr)
+	}
+	return nil
+}
+
+func (p *Pool) initialSize() int {
+	if p.InitialSize <= 0 {
+		return DefaultPoolInitialSize
+	}
+	return p.InitialSize
+}
+
+func (p *Pool) maxSize() int {
+	if p.MaxSize <= 0 {
+		return DefaultPoolMaxSize
+	}
+	return p.MaxSize
+}